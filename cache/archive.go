@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"fmt"
+	"sisyphus/conf"
+)
+
+// Formats of the cache archives. Downloads detect the format, so archives of any format can be restored
+const (
+	FormatGzip = "gzip"
+	FormatZstd = "zstd"
+	FormatNone = "none"
+)
+
+// Storage of the caches and the format of the archives uploaded by the jobs
+type Settings struct {
+	Backend Backend
+
+	Format string
+	// Compression level of the format, zero means the default of the compressor
+	Level int
+	// Larger archives are not uploaded. Zero means no limit
+	MaxSizeBytes int64
+}
+
+// Create the cache settings of the runner configuration. Returns nil when no cache is configured
+func NewSettings(sConf *conf.SisyphusConf) (*Settings, error) {
+	backend, err := NewBackend(sConf)
+	if err != nil || backend == nil {
+		return nil, err
+	}
+
+	c := sConf.Cache
+	format := c.Format
+	if len(format) == 0 {
+		format = FormatGzip
+	}
+
+	err = CheckFormat(format, c.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Settings{
+		Backend:      backend,
+		Format:       format,
+		Level:        c.CompressionLevel,
+		MaxSizeBytes: int64(c.MaxSizeMb) * 1024 * 1024,
+	}, nil
+}
+
+// Check the format and the compression level supported by it
+func CheckFormat(format string, level int) error {
+	maxLevel := 0
+	switch format {
+	case FormatGzip:
+		maxLevel = 9
+	case FormatZstd:
+		maxLevel = 19
+	case FormatNone:
+	default:
+		return fmt.Errorf("unknown cache format '%s'", format)
+	}
+
+	if level < 0 || level > maxLevel {
+		return fmt.Errorf("invalid compression level %d of cache format '%s'", level, format)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sisyphus/conf"
+	"strings"
+	"time"
+)
+
+// Signed URLs expire after this time unless configured otherwise or set for the job
+const DefaultUrlExpiry = 6 * time.Hour
+
+// S3 presigned URLs and GCS V4 signed URLs can not be valid longer
+const maxUrlExpiry = 7 * 24 * time.Hour
+
+// Default mount path of the cache volume in job pods
+const DefaultVolumeMountPath = "/cache"
+
+// Storage of cache archives. Generates shell commands for the job script.
+// Keys are relative paths of the archives, for example project/key.tar.gz.
+// Signed URLs are not written into the commands, they are added to secretEnv and the commands refer to their variables.
+// The job gets secretEnv in its environment
+type Backend interface {
+	// Human readable location of the archive
+	Location(key string) string
+
+	// Shell command downloading the archive into the file. Fails when the archive does not exist
+	DownloadCommand(key string, file string, secretEnv map[string]string) (string, error)
+
+	// Shell command uploading the file as the archive. The archive is replaced atomically when the upload completes,
+	// an interrupted upload leaves the previous archive in place.
+	// Single PUT to GCS or S3 already works like that, the object appears only when all its data is received
+	UploadCommand(key string, file string, secretEnv map[string]string) (string, error)
+}
+
+// Create the backend configured in the runner configuration. Returns nil when no cache is configured
+func NewBackend(sConf *conf.SisyphusConf) (Backend, error) {
+	c := sConf.Cache
+
+	expiry := DefaultUrlExpiry
+	if c.UrlExpirySec > 0 {
+		expiry = time.Duration(c.UrlExpirySec) * time.Second
+	}
+
+	switch c.Type {
+	case "":
+		if len(sConf.GcpCacheBucket) == 0 {
+			return nil, nil
+		}
+		return newGCSBackend(conf.GCSCacheConf{Bucket: sConf.GcpCacheBucket}, expiry)
+
+	case conf.CacheGCS:
+		return newGCSBackend(c.GCS, expiry)
+
+	case conf.CacheS3:
+		return newS3Backend(c.S3, expiry)
+
+	case conf.CacheVolume:
+		return newVolumeBackend(c.Volume)
+
+	default:
+		return nil, fmt.Errorf("unknown cache type '%s'", c.Type)
+	}
+}
+
+// Backends giving the jobs signed URLs
+type urlSigner interface {
+	withUrlExpiry(expiry time.Duration) Backend
+}
+
+// Copy of the backend signing URLs valid for the expiry. Other backends are returned as they are
+func WithUrlExpiry(backend Backend, expiry time.Duration) Backend {
+	if signer, ok := backend.(urlSigner); ok {
+		return signer.withUrlExpiry(expiry)
+	}
+
+	return backend
+}
+
+func limitUrlExpiry(expiry time.Duration) time.Duration {
+	if expiry > maxUrlExpiry {
+		return maxUrlExpiry
+	}
+
+	return expiry
+}
+
+// Add the signed URL to the secret environment. Returns the quoted reference to its variable.
+// The variable is named after the method and the key, so it is the same for each generation of the script
+func secretUrl(secretEnv map[string]string, method string, key string, url string) string {
+	hash := sha256.Sum256([]byte(method + " " + key))
+	name := "SFS_CACHE_URL_" + strings.ToUpper(hex.EncodeToString(hash[:8]))
+	secretEnv[name] = url
+	return `"${` + name + `}"`
+}
+
+// Quote the value for shell
+func Quote(val string) string {
+	return "'" + strings.Replace(val, "'", `'\''`, -1) + "'"
+}
+
+var errNoBucket = errors.New("cache bucket is not configured")
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"cloud.google.com/go/storage"
+	"fmt"
+	"golang.org/x/oauth2/google"
+	"io/ioutil"
+	"net/http"
+	"sisyphus/conf"
+	"time"
+)
+
+// Google cloud storage. Jobs use gsutil with the credentials of the pod,
+// or signed URLs when the runner has a service account key
+type gcsBackend struct {
+	bucket string
+	expiry time.Duration
+
+	// Set when URLs are signed
+	accessId   string
+	privateKey []byte
+}
+
+func newGCSBackend(c conf.GCSCacheConf, expiry time.Duration) (*gcsBackend, error) {
+	if len(c.Bucket) == 0 {
+		return nil, errNoBucket
+	}
+
+	b := &gcsBackend{
+		bucket: c.Bucket,
+		expiry: limitUrlExpiry(expiry),
+	}
+
+	if len(c.CredentialsFile) > 0 {
+		data, err := ioutil.ReadFile(c.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		jwt, err := google.JWTConfigFromJSON(data, storage.ScopeReadWrite)
+		if err != nil {
+			return nil, err
+		}
+
+		b.accessId = jwt.Email
+		b.privateKey = jwt.PrivateKey
+	}
+
+	return b, nil
+}
+
+func (b *gcsBackend) withUrlExpiry(expiry time.Duration) Backend {
+	result := *b
+	result.expiry = limitUrlExpiry(expiry)
+	return &result
+}
+
+func (b *gcsBackend) Location(key string) string {
+	return fmt.Sprintf("gs://%s/%s", b.bucket, key)
+}
+
+func (b *gcsBackend) DownloadCommand(key string, file string, secretEnv map[string]string) (string, error) {
+	if b.privateKey == nil {
+		return fmt.Sprintf("gsutil -q cp %s %s", Quote(b.Location(key)), Quote(file)), nil
+	}
+
+	signed, err := b.signUrl(http.MethodGet, key)
+	if err != nil {
+		return "", err
+	}
+
+	return curlDownload(secretUrl(secretEnv, http.MethodGet, key, signed), file), nil
+}
+
+func (b *gcsBackend) UploadCommand(key string, file string, secretEnv map[string]string) (string, error) {
+	if b.privateKey == nil {
+		return fmt.Sprintf("gsutil -q cp %s %s", Quote(file), Quote(b.Location(key))), nil
+	}
+
+	signed, err := b.signUrl(http.MethodPut, key)
+	if err != nil {
+		return "", err
+	}
+
+	return curlUpload(secretUrl(secretEnv, http.MethodPut, key, signed), file), nil
+}
+
+func (b *gcsBackend) signUrl(method string, key string) (string, error) {
+	return storage.SignedURL(b.bucket, key, &storage.SignedURLOptions{
+		GoogleAccessID: b.accessId,
+		PrivateKey:     b.privateKey,
+		Method:         method,
+		Expires:        time.Now().Add(b.expiry),
+		Scheme:         storage.SigningSchemeV4,
+	})
+}
+
+// The URL is a quoted shell word
+func curlDownload(url string, file string) string {
+	return fmt.Sprintf("curl -sSfL -o %s %s", Quote(file), url)
+}
+
+func curlUpload(url string, file string) string {
+	return fmt.Sprintf("curl -sSf -X PUT -T %s %s", Quote(file), url)
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sisyphus/conf"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 compatible storage. Jobs get URLs presigned with AWS signature V4, path-style addressing
+// is used so that any endpoint works, for example MinIO
+type s3Backend struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	expiry    time.Duration
+}
+
+func newS3Backend(c conf.S3CacheConf, expiry time.Duration) (*s3Backend, error) {
+	if len(c.Bucket) == 0 {
+		return nil, errNoBucket
+	}
+
+	if len(c.AccessKey) == 0 || len(c.SecretKey) == 0 {
+		return nil, errors.New("s3 cache credentials are not configured")
+	}
+
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoint.Scheme) == 0 || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s'", c.Endpoint)
+	}
+
+	region := c.Region
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	return &s3Backend{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    c.Bucket,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		expiry:    limitUrlExpiry(expiry),
+	}, nil
+}
+
+func (b *s3Backend) withUrlExpiry(expiry time.Duration) Backend {
+	result := *b
+	result.expiry = limitUrlExpiry(expiry)
+	return &result
+}
+
+func (b *s3Backend) Location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", b.bucket, key)
+}
+
+func (b *s3Backend) DownloadCommand(key string, file string, secretEnv map[string]string) (string, error) {
+	signed := b.presign(http.MethodGet, key, time.Now())
+	return curlDownload(secretUrl(secretEnv, http.MethodGet, key, signed), file), nil
+}
+
+func (b *s3Backend) UploadCommand(key string, file string, secretEnv map[string]string) (string, error) {
+	signed := b.presign(http.MethodPut, key, time.Now())
+	return curlUpload(secretUrl(secretEnv, http.MethodPut, key, signed), file), nil
+}
+
+func (b *s3Backend) presign(method string, key string, now time.Time) string {
+	path := strings.TrimRight(b.endpoint.Path, "/") + "/" + b.bucket + "/" + key
+	return presignV4(method, b.endpoint.Scheme, b.endpoint.Host, path, b.region, b.accessKey, b.secretKey, now, b.expiry)
+}
+
+// Presign URL with AWS signature V4 in query parameters. Only the host header is signed, the payload is not.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presignV4(method string, scheme string, host string, path string,
+	region string, accessKey string, secretKey string, now time.Time, expiry time.Duration) string {
+
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    accessKey + "/" + scope,
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, len(names))
+	for i, name := range names {
+		params[i] = awsEscape(name, false) + "=" + awsEscape(query[name], false)
+	}
+	canonicalQuery := strings.Join(params, "&")
+	canonicalPath := awsEscape(path, true)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalPath,
+		canonicalQuery,
+		"host:" + host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		query["X-Amz-Date"],
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", scheme, host, canonicalPath, canonicalQuery, signature)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URI encoding of AWS: everything except unreserved characters is percent encoded
+func awsEscape(val string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, c := range []byte(val) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Maximum length of the ref in the key, as in CI_COMMIT_REF_SLUG
+const maxRefSlugLength = 63
+
+// Keys are stored under the ref, protected refs apart from the unprotected ones
+type scopedBackend struct {
+	backend Backend
+	scope   string
+}
+
+// Wrap the backend, so the keys of a job are scoped by its ref
+func ScopeByRef(backend Backend, ref string, protected bool) Backend {
+	if backend == nil {
+		return nil
+	}
+
+	protection := "non_protected"
+	if protected {
+		protection = "protected"
+	}
+
+	return &scopedBackend{
+		backend: backend,
+		scope:   path.Join(protection, refSlug(ref)),
+	}
+}
+
+func (b *scopedBackend) withUrlExpiry(expiry time.Duration) Backend {
+	return &scopedBackend{
+		backend: WithUrlExpiry(b.backend, expiry),
+		scope:   b.scope,
+	}
+}
+
+// Only for messages, the commands reject keys leaving the scope
+func (b *scopedBackend) Location(key string) string {
+	return b.backend.Location(path.Join(b.scope, key))
+}
+
+func (b *scopedBackend) DownloadCommand(key string, file string, secretEnv map[string]string) (string, error) {
+	scopedKey, err := b.scopedKey(key)
+	if err != nil {
+		return "", err
+	}
+	return b.backend.DownloadCommand(scopedKey, file, secretEnv)
+}
+
+func (b *scopedBackend) UploadCommand(key string, file string, secretEnv map[string]string) (string, error) {
+	scopedKey, err := b.scopedKey(key)
+	if err != nil {
+		return "", err
+	}
+	return b.backend.UploadCommand(scopedKey, file, secretEnv)
+}
+
+// Key under the scope. Job variables in the key could otherwise reach the caches of other refs with .. segments
+func (b *scopedBackend) scopedKey(key string) (string, error) {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid cache key '%s'", key)
+		}
+	}
+
+	scopedKey := path.Join(b.scope, key)
+	if !strings.HasPrefix(scopedKey, b.scope+"/") {
+		return "", fmt.Errorf("cache key '%s' leaves the scope %s", key, b.scope)
+	}
+
+	return scopedKey, nil
+}
+
+// Lower case ref with all characters except a-z and 0-9 replaced by -, like CI_COMMIT_REF_SLUG
+func refSlug(ref string) string {
+	slug := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(ref))
+
+	if len(slug) > maxRefSlugLength {
+		slug = slug[:maxRefSlugLength]
+	}
+
+	slug = strings.Trim(slug, "-")
+	if len(slug) == 0 {
+		return "-"
+	}
+
+	return slug
+}
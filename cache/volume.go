@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sisyphus/conf"
+)
+
+// ReadWriteMany volume mounted into the job pods
+type volumeBackend struct {
+	mountPath string
+}
+
+func newVolumeBackend(c conf.VolumeCacheConf) (*volumeBackend, error) {
+	if len(c.ClaimName) == 0 {
+		return nil, errors.New("claim name of the cache volume is not configured")
+	}
+
+	mountPath := c.MountPath
+	if len(mountPath) == 0 {
+		mountPath = DefaultVolumeMountPath
+	}
+
+	return &volumeBackend{mountPath: mountPath}, nil
+}
+
+func (b *volumeBackend) Location(key string) string {
+	return path.Join(b.mountPath, key)
+}
+
+func (b *volumeBackend) DownloadCommand(key string, file string, _ map[string]string) (string, error) {
+	return fmt.Sprintf("cp %s %s", Quote(b.Location(key)), Quote(file)), nil
+}
+
+// The file is copied next to the archive and renamed, so jobs never see a partially written archive
+func (b *volumeBackend) UploadCommand(key string, file string, _ map[string]string) (string, error) {
+	location := b.Location(key)
+	return fmt.Sprintf(`mkdir -p %s && SFS_CACHE_TMP=$(mktemp %s) && { cp %s "${SFS_CACHE_TMP}" && chmod 644 "${SFS_CACHE_TMP}" && mv -f "${SFS_CACHE_TMP}" %s || { rm -f "${SFS_CACHE_TMP}"; false; }; }`,
+		Quote(path.Dir(location)), Quote(location+".XXXXXX"), Quote(file), Quote(location)), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sigs.k8s.io/yaml"
+	"sisyphus/cache"
+	"sisyphus/conf"
+	"sisyphus/kubernetes"
+	"sisyphus/protocol"
+	"strings"
+)
+
+// Exit codes of the subcommands
+const (
+	ExitOk = 0
+	// Gitlab not reachable, unexpected response, unreadable configuration
+	ExitFailure = 1
+	// Gitlab rejected the token
+	ExitInvalidToken = 2
+	// Wrong command line
+	ExitUsage = 3
+)
+
+// Subcommands for managing the runner registration and debugging. The runner itself is started without subcommand
+var commands = map[string]func(args []string) int{
+	"register":   registerCommand,
+	"unregister": unregisterCommand,
+	"verify":     verifyCommand,
+	"render":     renderCommand,
+}
+
+// Register new runner and write its token into the configuration
+func registerCommand(args []string) int {
+	var confPath, registrationToken, description, tags string
+	var runUntagged, locked bool
+
+	flags := flag.NewFlagSet("register", flag.ContinueOnError)
+	flags.StringVar(&confPath, "conf", "", "The `conf.yaml` file, the runner token is written to it")
+	flags.StringVar(&registrationToken, "registration-token", "", "Registration token of gitlab instance, group or project")
+	flags.StringVar(&description, "description", "", "Description of the runner, defaults to the runner name")
+	flags.StringVar(&tags, "tag-list", "", "Comma separated runner tags")
+	flags.BoolVar(&runUntagged, "run-untagged", false, "Run jobs without tags")
+	flags.BoolVar(&locked, "locked", false, "Lock the runner to the current project")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+
+	if len(confPath) == 0 || len(registrationToken) == 0 {
+		fmt.Fprintln(os.Stderr, "--conf and --registration-token are required")
+		return ExitUsage
+	}
+
+	rawConf, sConf, httpSession, err := loadCommandConf(confPath)
+	if err != nil {
+		return commandError(err)
+	}
+
+	if len(description) == 0 {
+		description = sConf.RunnerName
+	}
+
+	var tagList []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tagList = append(tagList, tag)
+		}
+	}
+
+	resp, err := httpSession.RegisterRunner(protocol.RegisterRunnerRequest{
+		Token:       registrationToken,
+		Description: description,
+		TagList:     tagList,
+		RunUntagged: runUntagged,
+		Locked:      locked,
+	})
+	if err != nil {
+		return commandError(err)
+	}
+
+	err = writeRunnerToken(confPath, rawConf, resp.Token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Runner %d is registered, but the token could not be saved: %v\n", resp.Id, err)
+		return ExitFailure
+	}
+
+	fmt.Printf("Runner %d is registered, the token is written to %s\n", resp.Id, confPath)
+	return ExitOk
+}
+
+// Delete the runner from gitlab and remove its token from the configuration
+func unregisterCommand(args []string) int {
+	confPath, ok := parseConfFlag("unregister", args)
+	if !ok {
+		return ExitUsage
+	}
+
+	rawConf, sConf, httpSession, err := loadCommandConf(confPath)
+	if err != nil {
+		return commandError(err)
+	}
+
+	err = httpSession.UnregisterRunner(sConf.RunnerToken)
+	if err != nil {
+		return commandError(err)
+	}
+
+	err = writeRunnerToken(confPath, rawConf, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Runner is unregistered, but the token could not be removed: %v\n", err)
+		return ExitFailure
+	}
+
+	fmt.Println("Runner is unregistered")
+	return ExitOk
+}
+
+// Check that gitlab accepts the runner token
+func verifyCommand(args []string) int {
+	confPath, ok := parseConfFlag("verify", args)
+	if !ok {
+		return ExitUsage
+	}
+
+	_, sConf, httpSession, err := loadCommandConf(confPath)
+	if err != nil {
+		return commandError(err)
+	}
+
+	err = httpSession.VerifyRunner(sConf.RunnerToken)
+	if err != nil {
+		return commandError(err)
+	}
+
+	fmt.Println("Runner token is valid")
+	return ExitOk
+}
+
+// Print the entrypoint script and manifests of K8S objects for a job spec, without contacting gitlab or K8S
+func renderCommand(args []string) int {
+	var confPath, jobPath string
+
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.StringVar(&confPath, "conf", "", "The `conf.yaml` file with job defaults")
+	flags.StringVar(&jobPath, "job", "", "The `spec.json` file with gitlab job spec")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+
+	if len(confPath) == 0 || len(jobPath) == 0 {
+		fmt.Fprintln(os.Stderr, "--conf and --job are required")
+		return ExitUsage
+	}
+
+	manifests, err := renderJob(confPath, jobPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailure
+	}
+
+	fmt.Print(manifests)
+	return ExitOk
+}
+
+func renderJob(confPath string, jobPath string) (string, error) {
+	rawConf, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return "", err
+	}
+
+	sConf, err := conf.ReadSisyphusConf(rawConf)
+	if err != nil {
+		return "", err
+	}
+
+	defaultRequests, err := parseDefaultResourceRequest(sConf)
+	if err != nil {
+		return "", err
+	}
+
+	objectMetaTemplates, err := kubernetes.NewObjectMetaTemplates(sConf.ExtraLabels, sConf.ExtraAnnotations)
+	if err != nil {
+		return "", err
+	}
+
+	rawSpec, err := ioutil.ReadFile(jobPath)
+	if err != nil {
+		return "", err
+	}
+
+	spec, err := protocol.ParseJobSpec(rawSpec)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := loadCustomK8SJobParams(protocol.GetEnvVars(spec), defaultRequests, sConf.DefaultNodeSelector)
+	if err != nil {
+		return "", err
+	}
+
+	params.Labels, params.Annotations, err = objectMetaTemplates.Render(kubernetes.NewJobMetadata(sConf.RunnerName, spec))
+	if err != nil {
+		return "", err
+	}
+
+	setCacheVolume(params, &sConf.Cache)
+
+	cacheSettings, err := cache.NewSettings(sConf)
+	if err != nil {
+		return "", err
+	}
+
+	jobCache := expireJobCache(scopeJobCache(cacheSettings, &sConf.Cache, spec), &sConf.Cache, spec, params)
+	manifests, err := kubernetes.RenderGitLabJob(spec, params, jobCache)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	out.WriteString("# entrypoint.sh\n")
+	for _, line := range strings.Split(strings.TrimRight(manifests.Script, "\n"), "\n") {
+		out.WriteString("# " + line + "\n")
+	}
+
+	for _, obj := range []interface{}{manifests.ConfigMap, manifests.Pvc, manifests.Job} {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return "", err
+		}
+
+		out.WriteString("---\n")
+		out.Write(data)
+	}
+
+	return out.String(), nil
+}
+
+func parseConfFlag(command string, args []string) (string, bool) {
+	var confPath string
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&confPath, "conf", "", "The `conf.yaml` file")
+	if err := flags.Parse(args); err != nil {
+		return "", false
+	}
+
+	if len(confPath) == 0 {
+		fmt.Fprintln(os.Stderr, "no configuration file provided. Use --conf")
+		return "", false
+	}
+
+	return confPath, true
+}
+
+func loadCommandConf(confPath string) ([]byte, *conf.SisyphusConf, *protocol.RunnerHttpSession, error) {
+	rawConf, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sConf, err := conf.ReadSisyphusConf(rawConf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(sConf.GitlabUrl) == 0 {
+		return nil, nil, nil, errors.New("gitlab_url is missing in the configuration")
+	}
+
+	httpSession, err := protocol.NewHttpSession(sConf.GitlabUrl)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return rawConf, sConf, httpSession, nil
+}
+
+func writeRunnerToken(confPath string, rawConf []byte, token string) error {
+	updated, err := conf.SetRunnerToken(rawConf, token)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(confPath)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(confPath, updated, info.Mode())
+}
+
+func commandError(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+
+	if err == protocol.ErrForbidden {
+		return ExitInvalidToken
+	}
+	return ExitFailure
+}
@@ -1,16 +1,19 @@
 package conf
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"regexp"
+	"strings"
 )
 
 type ResourceQuantity struct {
-	Type     v1.ResourceName `yaml:"type",json:"type"`
-	Quantity string          `yaml:"quantity",json:"quantity"`
+	Type     v1.ResourceName `yaml:"type" json:"type"`
+	Quantity string          `yaml:"quantity" json:"quantity"`
 }
 
 type SisyphusConf struct {
@@ -22,16 +25,114 @@ type SisyphusConf struct {
 	RunnerToken string `yaml:"runner_token"`
 	// Kubernetes namespace where everything will be created
 	K8SNamespace string `yaml:"k8s_namespace"`
-	// GCP cache bucket
+	// GCP cache bucket. Shortcut for gcs cache without credentials
 	GcpCacheBucket string `yaml:"gcp_cache_bucket"`
 
+	// Storage of job caches
+	Cache CacheConf `yaml:"cache"`
+
 	// Default node selector for new jobs
 	DefaultNodeSelector map[string]string `yaml:"default_node_selector"`
 
 	// Default resource requests for new jobs
 	DefaultResourceRequest []ResourceQuantity `yaml:"default_resource_request"`
+
+	// Extra labels and annotations of all objects created for a job. Values are go templates,
+	// for example "{{ .ProjectPath }}". Label values are sanitized to DNS-1123 labels
+	ExtraLabels      map[string]string `yaml:"extra_labels"`
+	ExtraAnnotations map[string]string `yaml:"extra_annotations"`
+
+	// Maximum number of jobs handled at the same time. Zero means no limit
+	Concurrent int `yaml:"concurrent"`
+
+	// Maximum number of running jobs of one project. Zero means no limit.
+	// A job received for a project at its limit waits for a slot. Waiting jobs count against concurrent
+	ProjectConcurrent int `yaml:"project_concurrent"`
+
+	// Limits for specific projects by project id, override project_concurrent
+	ProjectLimits map[int]int `yaml:"project_limits"`
+
+	// Address of the HTTP server with /metrics, /healthz and /readyz, for example ":9090". Empty disables the server
+	HttpAddress string `yaml:"http_address"`
+
+	// Jobs, configmaps, PVCs and secrets not used by any job monitor are deleted when they are older.
+	// Zero disables the orphan collector
+	OrphanTTLSec int `yaml:"orphan_ttl_sec"`
+
+	// On SIGTERM stop taking new jobs and wait this long for running jobs to finish. Jobs still running after it are failed.
+	// Zero stops the runner immediately, running jobs are resumed by the next instance of the runner
+	DrainTimeoutSec int `yaml:"drain_timeout_sec"`
+
+	// Backend running the jobs, ExecutorKubernetes or ExecutorLocal. Empty means kubernetes
+	Executor string `yaml:"executor"`
+
+	// Directory of the job scripts and builds of the local executor. Empty means the temp dir of the system
+	LocalBuildDir string `yaml:"local_build_dir"`
+}
+
+// Storage of job caches. Only the section of the type is used
+type CacheConf struct {
+	// One of CacheGCS, CacheS3, CacheVolume. Empty means gcs when gcp_cache_bucket is set, otherwise no cache
+	Type string `yaml:"type"`
+
+	// Signed URLs given to the jobs expire after this time, at most after 7 days.
+	// Zero means that they expire with the job: after its timeout plus its K8S deadline, which bounds the pending time
+	UrlExpirySec int `yaml:"url_expiry_sec"`
+
+	// Archive format: gzip (default), zstd or none. Jobs can choose another one with SFS_CACHE_FORMAT
+	Format string `yaml:"format"`
+	// Zero means the default level of the format. Jobs can choose another one with SFS_CACHE_COMPRESSION_LEVEL
+	CompressionLevel int `yaml:"compression_level"`
+	// Larger archives are not uploaded. Zero means no limit
+	MaxSizeMb int `yaml:"max_size_mb"`
+
+	// Keep caches of each ref separate, and caches of protected refs apart from the unprotected ones.
+	// Jobs of merge request branches then can not overwrite the cache of the default branch.
+	// Fallback keys are scoped as well, so they can not reach the cache of the default branch
+	ScopeByRef bool `yaml:"scope_by_ref"`
+
+	GCS    GCSCacheConf    `yaml:"gcs"`
+	S3     S3CacheConf     `yaml:"s3"`
+	Volume VolumeCacheConf `yaml:"volume"`
+}
+
+type GCSCacheConf struct {
+	Bucket string `yaml:"bucket"`
+	// JSON key of service account. When set, jobs get signed URLs and do not need gsutil
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+// S3 compatible storage, for example AWS or MinIO. Jobs get presigned URLs, the keys stay in the runner
+type S3CacheConf struct {
+	// For example https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// ReadWriteMany volume mounted into all job pods
+type VolumeCacheConf struct {
+	ClaimName string `yaml:"claim_name"`
+	// Empty means /cache
+	MountPath string `yaml:"mount_path"`
 }
 
+// Types of cache storage
+const (
+	CacheGCS    = "gcs"
+	CacheS3     = "s3"
+	CacheVolume = "volume"
+)
+
+// Executors of the jobs
+const (
+	ExecutorKubernetes = "kubernetes"
+	// Jobs run as processes of the runner host. For development only
+	ExecutorLocal = "local"
+)
+
 func ReadSisyphusConf(yamlRaw []byte) (*SisyphusConf, error) {
 	var conf SisyphusConf
 
@@ -43,6 +144,43 @@ func ReadSisyphusConf(yamlRaw []byte) (*SisyphusConf, error) {
 	return &conf, nil
 }
 
+// Top level runner_token line of the configuration
+var runnerTokenLine = regexp.MustCompile(`(?m)^runner_token:.*$`)
+
+// Replace runner token in the configuration. Only the runner_token line is rewritten, or appended when missing,
+// so the rest of the file keeps its formatting and comments
+func SetRunnerToken(yamlRaw []byte, token string) ([]byte, error) {
+	value, err := yaml.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	line := "runner_token: " + strings.TrimSuffix(string(value), "\n")
+
+	var updated []byte
+	if loc := runnerTokenLine.FindIndex(yamlRaw); loc != nil {
+		updated = append(updated, yamlRaw[:loc[0]]...)
+		updated = append(updated, line...)
+		updated = append(updated, yamlRaw[loc[1]:]...)
+	} else {
+		updated = append(updated, yamlRaw...)
+		if len(updated) > 0 && !bytes.HasSuffix(updated, []byte("\n")) {
+			updated = append(updated, '\n')
+		}
+		updated = append(updated, line+"\n"...)
+	}
+
+	// a token written in another form, for example as a block scalar, can not be replaced by its line
+	conf, err := ReadSisyphusConf(updated)
+	if err != nil {
+		return nil, err
+	}
+	if conf.RunnerToken != token {
+		return nil, errors.New("runner_token can not be replaced, set it on a single line")
+	}
+
+	return updated, nil
+}
+
 func writeConf(conf *SisyphusConf) ([]byte, error) {
 	raw, err := yaml.Marshal(conf)
 
@@ -14,6 +14,22 @@ func Test_Conf(t *testing.T) {
 		GcpCacheBucket: "test_bucket",
 		K8SNamespace:   "builder",
 
+		Cache: CacheConf{
+			Type:             CacheS3,
+			UrlExpirySec:     3600,
+			ScopeByRef:       true,
+			Format:           "zstd",
+			CompressionLevel: 3,
+			MaxSizeMb:        2048,
+			S3: S3CacheConf{
+				Endpoint:  "http://minio:9000",
+				Region:    "us-east-1",
+				Bucket:    "cache",
+				AccessKey: "minio",
+				SecretKey: "minio123",
+			},
+		},
+
 		DefaultNodeSelector: map[string]string{
 			"cloud.google.com/gke-preemptible": "true",
 			"class":                            "sisyphus",
@@ -22,6 +38,27 @@ func Test_Conf(t *testing.T) {
 		DefaultResourceRequest: []ResourceQuantity{
 			{Type: "cpu", Quantity: "1000m"},
 		},
+
+		ExtraLabels: map[string]string{
+			"cost-center": "ci-{{ .ProjectId }}",
+		},
+		ExtraAnnotations: map[string]string{
+			"example.com/pipeline": "{{ .PipelineId }}",
+		},
+
+		Concurrent:        20,
+		ProjectConcurrent: 5,
+		ProjectLimits: map[int]int{
+			42: 10,
+		},
+
+		HttpAddress: ":9090",
+
+		OrphanTTLSec:    7200,
+		DrainTimeoutSec: 600,
+
+		Executor:      ExecutorLocal,
+		LocalBuildDir: "/tmp/sisyphus",
 	}
 
 	r, err := writeConf(&orig)
@@ -41,3 +78,46 @@ func Test_Conf(t *testing.T) {
 		t.Errorf("YAML parsing failed: got %v, want %v", deser, orig)
 	}
 }
+
+func TestSetRunnerToken(t *testing.T) {
+	raw := []byte("# runner of the CI cluster\nrunner_name: test\nrunner_token: old # set by register\n\nk8s_namespace: builder  # jobs\n")
+
+	updated, err := SetRunnerToken(raw, "new-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# runner of the CI cluster\nrunner_name: test\nrunner_token: new-token\n\nk8s_namespace: builder  # jobs\n"
+	if string(updated) != want {
+		t.Errorf("got %q, want %q", updated, want)
+	}
+
+	updated, err = SetRunnerToken([]byte("runner_name: test # no token yet"), "new-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ReadSisyphusConf(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.RunnerToken != "new-token" || conf.RunnerName != "test" {
+		t.Errorf("unexpected conf %+v", conf)
+	}
+
+	// values which are not plain YAML scalars are quoted
+	updated, err = SetRunnerToken(raw, "123: #x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err = ReadSisyphusConf(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.RunnerToken != "123: #x" {
+		t.Errorf("unexpected token %q", conf.RunnerToken)
+	}
+}
@@ -0,0 +1,100 @@
+// Backends running the jobs and the types they share with the job monitor
+package executor
+
+import (
+	"errors"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	"sisyphus/cache"
+	"sisyphus/protocol"
+	"time"
+)
+
+// The job or its log is not known to the executor
+var ErrJobNotFound = errors.New("job not found")
+
+// Backend running the job scripts. Kubernetes is the default
+type Executor interface {
+	// Create the job and start it
+	CreateJob(spec *protocol.JobSpec, params *JobParameters, cacheSettings *cache.Settings) (Job, error)
+}
+
+// Job started by an executor
+type Job interface {
+	Name() string
+
+	// Current status of the job. Returns ErrJobNotFound when the job is gone or not known yet
+	Status() (*JobStatus, error)
+
+	// Notifications of status changes. The function unsubscribes
+	Subscribe() (<-chan struct{}, func())
+
+	// Follow the builder log of the source from JobStatus. Each line starts with RFC3339 timestamp.
+	// The stream ends when the builder terminates
+	StreamLog(source string, sinceTime *time.Time) (io.ReadCloser, error)
+
+	// The job keeps running without the runner and its next instance resumes it.
+	// Jobs which can not be resumed are failed when the runner stops
+	Resumable() bool
+
+	// Save progress of the gitlab trace, so the job can be resumed after runner restart
+	SaveTraceCheckpoint(cp TraceCheckpoint) error
+
+	// Stop the job and delete its resources
+	Delete() error
+}
+
+type JobState int
+
+const (
+	JobPending JobState = iota
+	JobRunning
+	JobSucceeded
+	JobFailed
+)
+
+// State of the job independent of the executor
+type JobStatus struct {
+	State JobState
+
+	// Log of the builder, set when the builder is started. Changes when the builder is restarted
+	LogSource string
+
+	// Zero when unknown
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+
+	// Human readable state of the job, for example of its pods
+	Info string
+
+	// Set for failed jobs
+	FailureReason protocol.JobFailureReason
+	ExitCode      int
+
+	// Explanation of the final state
+	Details string
+}
+
+// Additional parameters of the job. Executors ignore the ones they do not support
+type JobParameters struct {
+	NodeSelector      map[string]string `json:"node_selector"`
+	ResourceRequest   v1.ResourceList   `json:"resource_request"`
+	ActiveDeadlineSec int64             `json:"active_deadline_sec"`
+
+	// Set on all objects of the job
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ReadWriteMany claim with job caches, mounted into the builder. Optional
+	CacheVolumeClaim string `json:"cache_volume_claim,omitempty"`
+	CacheVolumePath  string `json:"cache_volume_path,omitempty"`
+}
+
+// Progress of the gitlab trace. Saved after each PATCH, so the restarted runner continues where it stopped
+type TraceCheckpoint struct {
+	// Offset of the next trace PATCH
+	Offset int
+	// Timestamp of the last pod log line written to the trace
+	LastTimestamp *time.Time
+}
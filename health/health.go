@@ -0,0 +1,123 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The fetch loop ticks every second. Longer silence means it is stuck
+const DefaultPollTimeout = 2 * time.Minute
+
+// Health of the runner for liveness and readiness probes
+type Monitor struct {
+	mux sync.Mutex
+
+	// Last iteration of the fetch loop
+	lastHeartbeat time.Time
+	// Result of the last request to gitlab
+	gitlabErr error
+	// Runner stopped taking new jobs
+	draining bool
+
+	pollTimeout time.Duration
+	k8sCheck    func() error
+}
+
+// Create monitor. The K8S check is called on every readiness probe
+func NewMonitor(pollTimeout time.Duration, k8sCheck func() error) *Monitor {
+	return &Monitor{
+		lastHeartbeat: time.Now(),
+		pollTimeout:   pollTimeout,
+		k8sCheck:      k8sCheck,
+	}
+}
+
+// Called by the fetch loop on every iteration, including those skipped at capacity
+func (m *Monitor) Heartbeat() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.lastHeartbeat = time.Now()
+}
+
+// Record result of gitlab request
+func (m *Monitor) GitLabRequestDone(err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.gitlabErr = err
+}
+
+// Fetch loop terminates while draining, that is not a failure
+func (m *Monitor) SetDraining() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.draining = true
+}
+
+// Liveness: the fetch loop is alive
+func (m *Monitor) checkAlive() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.draining {
+		return nil
+	}
+
+	if silence := time.Since(m.lastHeartbeat); silence > m.pollTimeout {
+		return fmt.Errorf("fetch loop is stuck for %s", silence.Round(time.Second))
+	}
+
+	return nil
+}
+
+// Readiness: alive, not draining and both gitlab and K8S are reachable
+func (m *Monitor) checkReady() error {
+	if err := m.checkAlive(); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	draining, gitlabErr := m.draining, m.gitlabErr
+	m.mux.Unlock()
+
+	if draining {
+		return fmt.Errorf("runner is draining")
+	}
+
+	if gitlabErr != nil {
+		return fmt.Errorf("last gitlab request failed: %v", gitlabErr)
+	}
+
+	if m.k8sCheck != nil {
+		if err := m.k8sCheck(); err != nil {
+			return fmt.Errorf("K8S is not reachable: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Handler for /healthz
+func (m *Monitor) HealthzHandler() http.Handler {
+	return checkHandler(m.checkAlive)
+}
+
+// Handler for /readyz
+func (m *Monitor) ReadyzHandler() http.Handler {
+	return checkHandler(m.checkReady)
+}
+
+func checkHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
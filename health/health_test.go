@@ -0,0 +1,54 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(h http.Handler) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code
+}
+
+func TestMonitor(t *testing.T) {
+	var k8sErr error
+	m := NewMonitor(time.Minute, func() error { return k8sErr })
+
+	if code := probe(m.ReadyzHandler()); code != http.StatusOK {
+		t.Errorf("fresh runner is not ready: %d", code)
+	}
+
+	m.GitLabRequestDone(errors.New("connection refused"))
+	if code := probe(m.ReadyzHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("runner without gitlab is ready: %d", code)
+	}
+
+	m.GitLabRequestDone(nil)
+	k8sErr = errors.New("forbidden")
+	if code := probe(m.ReadyzHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("runner without K8S is ready: %d", code)
+	}
+
+	if code := probe(m.HealthzHandler()); code != http.StatusOK {
+		t.Errorf("runner with live fetch loop is not healthy: %d", code)
+	}
+
+	m.lastHeartbeat = time.Now().Add(-2 * time.Minute)
+	if code := probe(m.HealthzHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("runner with stuck fetch loop is healthy: %d", code)
+	}
+
+	m.SetDraining()
+	if code := probe(m.HealthzHandler()); code != http.StatusOK {
+		t.Errorf("draining runner is not healthy: %d", code)
+	}
+
+	k8sErr = nil
+	if code := probe(m.ReadyzHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("draining runner is ready: %d", code)
+	}
+}
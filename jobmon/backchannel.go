@@ -3,7 +3,9 @@ package jobmon
 import (
 	"errors"
 	"github.com/sirupsen/logrus"
+	"sisyphus/metrics"
 	"sisyphus/protocol"
+	"time"
 )
 
 type gitLabBackChannel struct {
@@ -13,8 +15,19 @@ type gitLabBackChannel struct {
 	localLogger    *logrus.Entry
 }
 
+// Final outcome of the job
+type jobResult struct {
+	state         protocol.JobState
+	failureReason protocol.JobFailureReason
+	exitCode      int
+}
+
 func (bc *gitLabBackChannel) syncJobStatus(state protocol.JobState) (*protocol.RemoteJobState, error) {
-	z, err := bc.httpSession.UpdateJobStatus(bc.jobId, bc.gitlabJobToken, state)
+	return bc.syncJobResult(jobResult{state: state})
+}
+
+func (bc *gitLabBackChannel) syncJobResult(result jobResult) (*protocol.RemoteJobState, error) {
+	z, err := bc.httpSession.UpdateJobStatus(bc.jobId, bc.gitlabJobToken, result.state, result.failureReason, result.exitCode)
 
 	if err != nil {
 		return nil, err
@@ -27,5 +40,15 @@ func (bc *gitLabBackChannel) syncJobStatus(state protocol.JobState) (*protocol.R
 }
 
 func (bc *gitLabBackChannel) writeLogLines(content []byte, startOffset int) (*protocol.ContentRange, error) {
-	return bc.httpSession.PatchJobLog(bc.jobId, bc.gitlabJobToken, content, startOffset)
+	start := time.Now()
+	contentRange, err := bc.httpSession.PatchJobLog(bc.jobId, bc.gitlabJobToken, content, startOffset)
+	metrics.TraceDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		metrics.TraceErrors.Inc()
+	} else {
+		metrics.TraceBytes.Add(float64(len(content)))
+	}
+
+	return contentRange, err
 }
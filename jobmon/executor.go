@@ -0,0 +1,161 @@
+package jobmon
+
+import (
+	"fmt"
+	"io"
+	v12 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	errors2 "k8s.io/apimachinery/pkg/api/errors"
+	"sisyphus/cache"
+	"sisyphus/executor"
+	k "sisyphus/kubernetes"
+	"sisyphus/protocol"
+	"strings"
+	"time"
+)
+
+// Jobs are created in K8S, their status is read from the watcher cache
+type k8sExecutor struct {
+	session *k.Session
+	watcher *k.JobWatcher
+}
+
+func NewK8SExecutor(session *k.Session, watcher *k.JobWatcher) executor.Executor {
+	return &k8sExecutor{
+		session: session,
+		watcher: watcher,
+	}
+}
+
+func (e *k8sExecutor) CreateJob(spec *protocol.JobSpec, k8sJobParams *executor.JobParameters, cacheSettings *cache.Settings) (executor.Job, error) {
+	job, err := e.session.CreateGitLabJob(k.JobNamePrefix(spec), spec, k8sJobParams, cacheSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	return newK8SJob(job, e.watcher), nil
+}
+
+type k8sJob struct {
+	job     *k.Job
+	watcher *k.JobWatcher
+
+	// When the image pull errors started
+	imagePullFailingSince time.Time
+}
+
+func newK8SJob(job *k.Job, watcher *k.JobWatcher) *k8sJob {
+	return &k8sJob{
+		job:     job,
+		watcher: watcher,
+	}
+}
+
+func (j *k8sJob) Name() string {
+	return j.job.Name
+}
+
+func (j *k8sJob) Status() (*executor.JobStatus, error) {
+	status, err := j.watcher.GetK8SJobStatus(j.job)
+	if errors2.IsNotFound(err) {
+		return nil, executor.ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	js := status.Job.Status
+	result := &executor.JobStatus{
+		State:   executor.JobPending,
+		Created: status.Job.CreationTimestamp.Time,
+		Info:    podsInfoMessage(status.Pods),
+	}
+
+	if js.StartTime != nil {
+		result.Started = js.StartTime.Time
+	}
+	if js.CompletionTime != nil {
+		result.Finished = js.CompletionTime.Time
+	}
+
+	// The pod must be not in pending or unknown state to have logs
+	builderPhase := status.PodPhases[k.ContainerNameBuilder]
+	if builderPhase == v1.PodRunning || builderPhase == v1.PodSucceeded || builderPhase == v1.PodFailed {
+		podName, err := findPodOfContainer(status.Pods, k.ContainerNameBuilder)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", err, result.Info)
+		}
+
+		result.State = executor.JobRunning
+		result.LogSource = podName
+	}
+
+	isFailure, failureCond := checkJobConditions(js.Conditions, v12.JobFailed)
+	isSuccess, successCond := checkJobConditions(js.Conditions, v12.JobComplete)
+
+	// With services the pod keeps running, the builder exit code decides the outcome
+	if !isFailure && !isSuccess && j.job.HasSidecars() {
+		if term := status.BuilderTerminated(); term != nil {
+			isSuccess = term.ExitCode == 0
+			isFailure = !isSuccess
+		}
+	}
+
+	var details []string
+
+	// Pods which can not pull the image are pending until the deadline
+	if pullFailure := findImagePullFailure(status.Pods); len(pullFailure) > 0 {
+		if j.imagePullFailingSince.IsZero() {
+			j.imagePullFailingSince = time.Now()
+		}
+
+		if time.Since(j.imagePullFailingSince) > ImagePullFailureTimeout {
+			details = append(details, fmt.Sprintf("Image pull failed for %s: %s", ImagePullFailureTimeout, pullFailure))
+			isFailure = true
+		}
+	} else {
+		j.imagePullFailingSince = time.Time{}
+	}
+
+	switch {
+	case isFailure:
+		result.State = executor.JobFailed
+		result.FailureReason, result.ExitCode = classifyFailure(status, failureCond)
+		if failureCond != nil {
+			details = append(details, renderJson(failureCond))
+		}
+
+	case isSuccess:
+		result.State = executor.JobSucceeded
+		if successCond != nil {
+			details = append(details, renderJson(successCond))
+		}
+	}
+
+	result.Details = strings.Join(details, "\n")
+	return result, nil
+}
+
+func (j *k8sJob) Subscribe() (<-chan struct{}, func()) {
+	return j.watcher.Subscribe(j.job)
+}
+
+func (j *k8sJob) StreamLog(podName string, sinceTime *time.Time) (io.ReadCloser, error) {
+	stream, err := j.job.StreamPodLog(podName, sinceTime)
+	if errors2.IsNotFound(err) {
+		return nil, executor.ErrJobNotFound
+	}
+
+	return stream, err
+}
+
+func (j *k8sJob) Resumable() bool {
+	return true
+}
+
+func (j *k8sJob) SaveTraceCheckpoint(cp executor.TraceCheckpoint) error {
+	return j.job.SaveTraceCheckpoint(cp)
+}
+
+func (j *k8sJob) Delete() error {
+	return j.job.Delete()
+}
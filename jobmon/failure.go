@@ -0,0 +1,91 @@
+package jobmon
+
+import (
+	"fmt"
+	v12 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	k "sisyphus/kubernetes"
+	"sisyphus/protocol"
+	"time"
+)
+
+// The pod stays pending when the image can not be pulled. Fail the job instead of waiting for the deadline
+const ImagePullFailureTimeout = 3 * time.Minute
+
+// Reason of the failed job condition set by the K8S job controller when ActiveDeadlineSeconds of the job is exceeded.
+// The kubelet sets the same reason on the status of a pod which exceeded its own ActiveDeadlineSeconds
+const jobReasonDeadlineExceeded = "DeadlineExceeded"
+
+// Container waiting reasons which mean that the image can not be pulled
+var imagePullFailureReasons = map[string]bool{
+	"ErrImagePull":        true,
+	"ImagePullBackOff":    true,
+	"InvalidImageName":    true,
+	"ErrImageNeverPull":   true,
+	"RegistryUnavailable": true,
+}
+
+// Find the failure reason of the job and the exit code of the builder
+func classifyFailure(status *k.K8SJobStatus, failureCond *v12.JobCondition) (protocol.JobFailureReason, int) {
+	exitCode := 0
+	if term := status.LastBuilderTermination(); term != nil {
+		exitCode = int(term.ExitCode)
+	}
+
+	switch {
+	case len(findImagePullFailure(status.Pods)) > 0:
+		return protocol.ImagePullFailure, exitCode
+
+	case isUnschedulable(status.Pods):
+		return protocol.SchedulerFailure, exitCode
+
+	case failureCond != nil && failureCond.Reason == jobReasonDeadlineExceeded, isDeadlineExceeded(status.Pods):
+		return protocol.StuckOrTimeoutFailure, exitCode
+
+	case exitCode != 0:
+		return protocol.ScriptFailure, exitCode
+
+	default:
+		// The builder did not report an exit code: the pod was evicted, the node was lost etc.
+		return protocol.RunnerSystemFailure, exitCode
+	}
+}
+
+// Describe the first container which can not pull its image. Empty if there is none
+func findImagePullFailure(pods []v1.Pod) string {
+	for _, p := range pods {
+		for _, cs := range p.Status.ContainerStatuses {
+			w := cs.State.Waiting
+			if w != nil && imagePullFailureReasons[w.Reason] {
+				return fmt.Sprintf("container '%s' image '%s': %s %s", cs.Name, cs.Image, w.Reason, w.Message)
+			}
+		}
+	}
+
+	return ""
+}
+
+// Check if the scheduler can not find a node for a pod
+func isUnschedulable(pods []v1.Pod) bool {
+	for _, p := range pods {
+		for _, cond := range p.Status.Conditions {
+			if cond.Type == v1.PodScheduled && cond.Status == v1.ConditionFalse && cond.Reason == v1.PodReasonUnschedulable {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Check if the kubelet killed a pod at its deadline. Jobs created by older runners have the deadline on the pod,
+// the job then fails with BackoffLimitExceeded
+func isDeadlineExceeded(pods []v1.Pod) bool {
+	for _, p := range pods {
+		if p.Status.Reason == jobReasonDeadlineExceeded {
+			return true
+		}
+	}
+
+	return false
+}
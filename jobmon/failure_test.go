@@ -0,0 +1,118 @@
+package jobmon
+
+import (
+	v12 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	k "sisyphus/kubernetes"
+	"sisyphus/protocol"
+	"testing"
+)
+
+func builderPod(state v1.ContainerState, last v1.ContainerState) v1.Pod {
+	return v1.Pod{
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{
+				{
+					Name:                 k.ContainerNameBuilder,
+					State:                state,
+					LastTerminationState: last,
+				},
+			},
+		},
+	}
+}
+
+func Test_classifyFailure(t *testing.T) {
+	terminated := func(code int32) v1.ContainerState {
+		return v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: code}}
+	}
+
+	unschedulable := v1.Pod{
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{
+				{Type: v1.PodScheduled, Status: v1.ConditionFalse, Reason: v1.PodReasonUnschedulable},
+			},
+		},
+	}
+
+	deadlineExceeded := builderPod(terminated(137), v1.ContainerState{})
+	deadlineExceeded.Status.Phase = v1.PodFailed
+	deadlineExceeded.Status.Reason = "DeadlineExceeded"
+	deadlineExceeded.Status.Message = "Pod was active on the node longer than the specified deadline"
+
+	tests := []struct {
+		name         string
+		pods         []v1.Pod
+		cond         *v12.JobCondition
+		wantReason   protocol.JobFailureReason
+		wantExitCode int
+	}{
+		{
+			name:         "script failure",
+			pods:         []v1.Pod{builderPod(terminated(2), v1.ContainerState{})},
+			wantReason:   protocol.ScriptFailure,
+			wantExitCode: 2,
+		},
+		{
+			name:         "script failure before restart",
+			pods:         []v1.Pod{builderPod(v1.ContainerState{}, terminated(3))},
+			wantReason:   protocol.ScriptFailure,
+			wantExitCode: 3,
+		},
+		{
+			// The job controller deletes the pods of a job which exceeded its deadline
+			name:       "job deadline",
+			pods:       nil,
+			cond:       &v12.JobCondition{Type: v12.JobFailed, Reason: jobReasonDeadlineExceeded, Message: "Job was active longer than specified deadline"},
+			wantReason: protocol.StuckOrTimeoutFailure,
+		},
+		{
+			name:         "job deadline while pod terminates",
+			pods:         []v1.Pod{builderPod(terminated(143), v1.ContainerState{})},
+			cond:         &v12.JobCondition{Type: v12.JobFailed, Reason: jobReasonDeadlineExceeded},
+			wantReason:   protocol.StuckOrTimeoutFailure,
+			wantExitCode: 143,
+		},
+		{
+			// Jobs created by older runners have the deadline on the pod. The kubelet kills the pod, the job reaches its backoff limit
+			name:         "pod deadline",
+			pods:         []v1.Pod{deadlineExceeded},
+			cond:         &v12.JobCondition{Type: v12.JobFailed, Reason: "BackoffLimitExceeded", Message: "Job has reached the specified backoff limit"},
+			wantReason:   protocol.StuckOrTimeoutFailure,
+			wantExitCode: 137,
+		},
+		{
+			name: "image pull",
+			pods: []v1.Pod{builderPod(v1.ContainerState{
+				Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"},
+			}, v1.ContainerState{})},
+			wantReason: protocol.ImagePullFailure,
+		},
+		{
+			name:       "unschedulable",
+			pods:       []v1.Pod{unschedulable},
+			cond:       &v12.JobCondition{Type: v12.JobFailed, Reason: jobReasonDeadlineExceeded},
+			wantReason: protocol.SchedulerFailure,
+		},
+		{
+			name:       "pod lost",
+			pods:       nil,
+			cond:       &v12.JobCondition{Type: v12.JobFailed, Reason: "BackoffLimitExceeded"},
+			wantReason: protocol.RunnerSystemFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &k.K8SJobStatus{Pods: tt.pods}
+			reason, exitCode := classifyFailure(status, tt.cond)
+
+			if reason != tt.wantReason {
+				t.Errorf("reason: got %s, want %s", reason, tt.wantReason)
+			}
+			if exitCode != tt.wantExitCode {
+				t.Errorf("exit code: got %d, want %d", exitCode, tt.wantExitCode)
+			}
+		})
+	}
+}
@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	v12 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	"net/http"
+	"sisyphus/cache"
+	"sisyphus/executor"
 	k "sisyphus/kubernetes"
+	"sisyphus/metrics"
 	"sisyphus/protocol"
 	"strings"
 	"time"
@@ -16,18 +20,18 @@ import (
 
 // Create job from descriptor and monitor loop
 func RunJob(spec *protocol.JobSpec,
-	k8sSession *k.Session,
-	k8sJobParams *k.K8SJobParameters,
+	backend executor.Executor,
+	params *executor.JobParameters,
 	httpSession *protocol.RunnerHttpSession,
-	cacheBucket string,
+	cacheSettings *cache.Settings,
 	stopChan <-chan bool,
+	killChan <-chan bool,
 	tickGitLabLog *time.Ticker) {
 
-	jobPrefix := fmt.Sprintf("sphs-%v-%v-", spec.JobInfo.ProjectId, spec.Id)
-
-	rrq, err := protocol.ToFlatJson(k8sJobParams)
+	rrq, err := protocol.ToFlatJson(params)
 	if err != nil {
 		logrus.Error(err)
+		FailJob(spec, httpSession, protocol.RunnerSystemFailure, err)
 		return
 	}
 
@@ -37,33 +41,76 @@ func RunJob(spec *protocol.JobSpec,
 		"jobId":   spec.Id,
 	}).Infof("Starting new job with parameters %s", rrq)
 
-	job, err := k8sSession.CreateGitLabJob(jobPrefix, spec, k8sJobParams, cacheBucket)
+	job, err := backend.CreateJob(spec, params, cacheSettings)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to create K8S job for project=%v, job=%v, job_id=%v",
+		msg := fmt.Sprintf("Failed to create job for project=%v, job=%v, job_id=%v",
 			spec.JobInfo.ProjectName,
 			spec.JobInfo.Name,
 			spec.Id)
 
 		logrus.Error(msg)
 		logrus.Error(err)
+		metrics.K8SErrors.WithLabelValues(metrics.OpCreateJob).Inc()
+		FailJob(spec, httpSession, protocol.RunnerSystemFailure, fmt.Errorf("failed to create job: %v", err))
 		return
 	} else {
-		monitorJob(job, httpSession, spec.Id, spec.Token, stopChan, tickGitLabLog)
+		monitorJob(job, httpSession, spec.Id, spec.JobInfo.ProjectId, spec.Token, protocol.GetSecretValues(spec), nil, stopChan, killChan, tickGitLabLog)
 	}
 }
 
-// Monitor job loop
-func monitorJob(job *k.Job, httpSession *protocol.RunnerHttpSession, jobId int, gitlabJobToken string, stopChan <-chan bool, tickGitLabLog *time.Ticker) {
+// Continue monitoring of the job left running by the previous instance of the runner
+func ResumeJob(rj *k.ResumableJob,
+	watcher *k.JobWatcher,
+	httpSession *protocol.RunnerHttpSession,
+	stopChan <-chan bool,
+	killChan <-chan bool,
+	tickGitLabLog *time.Ticker) {
+
+	logrus.WithFields(map[string]interface{}{
+		"k8sjob": rj.Job.Name,
+		"jobId":  rj.GitLabJobId,
+	}).Infof("Resuming job from trace offset %d", rj.Checkpoint.Offset)
+
+	monitorJob(newK8SJob(rj.Job, watcher), httpSession, rj.GitLabJobId, rj.ProjectId, rj.Token, rj.MaskedValues, &rj.Checkpoint, stopChan, killChan, tickGitLabLog)
+}
+
+// Fail the gitlab job which could not be started. The cause is written to the job trace
+func FailJob(spec *protocol.JobSpec, httpSession *protocol.RunnerHttpSession, reason protocol.JobFailureReason, cause error) {
 	ctxLogger := logrus.WithFields(
 		logrus.Fields{
-			"k8sjob":    job.Name,
-			"gitlabjob": jobId,
+			"gitlabjob": spec.Id,
 		})
 
-	loggingState := newLogState(ctxLogger)
+	loggingState := newLogState(ctxLogger, protocol.GetSecretValues(spec))
+	labLog := newGitLabTraceLogger(loggingState)
 
-	// Logger for gitlab trace
-	// Writes log messages directly to gitlab console
+	backChannel := gitLabBackChannel{
+		httpSession:    httpSession,
+		jobId:          spec.Id,
+		gitlabJobToken: spec.Token,
+		localLogger:    ctxLogger,
+	}
+
+	ctxLogger.Warnf("Failing job, reason %s: %s", reason, cause)
+	labLog.Errorf("The job could not be started: %s", cause)
+
+	err := loggingState.flush()
+	if err != nil {
+		ctxLogger.Warn(err)
+	}
+
+	_, err = pushLogsToGitlab(loggingState, &backChannel)
+	if err != nil {
+		ctxLogger.Warn(err)
+	}
+
+	syncJobStateLoop(&backChannel, jobResult{state: protocol.Failed, failureReason: reason}, ctxLogger)
+	metrics.JobFinished(spec.JobInfo.ProjectId, metrics.StatusFailed, time.Time{})
+}
+
+// Logger for gitlab trace
+// Writes log messages directly to gitlab console
+func newGitLabTraceLogger(out io.Writer) *logrus.Logger {
 	labLog := logrus.New()
 	labLog.SetLevel(logrus.DebugLevel)
 	labLog.SetFormatter(&logrus.TextFormatter{
@@ -71,7 +118,37 @@ func monitorJob(job *k.Job, httpSession *protocol.RunnerHttpSession, jobId int,
 		FullTimestamp:          true,
 		DisableLevelTruncation: true,
 	})
-	labLog.SetOutput(loggingState.logBuffer)
+	labLog.SetOutput(out)
+
+	return labLog
+}
+
+// Monitor job loop. The checkpoint is set when the job is resumed after runner restart.
+// The job is detached when stopChan is closed and failed when killChan is closed
+func monitorJob(job executor.Job,
+	httpSession *protocol.RunnerHttpSession,
+	jobId int,
+	projectId int,
+	gitlabJobToken string,
+	secrets []string,
+	checkpoint *executor.TraceCheckpoint,
+	stopChan <-chan bool,
+	killChan <-chan bool,
+	tickGitLabLog *time.Ticker) {
+
+	ctxLogger := logrus.WithFields(
+		logrus.Fields{
+			"k8sjob":    job.Name(),
+			"gitlabjob": jobId,
+		})
+
+	loggingState := newLogState(ctxLogger, secrets)
+	if checkpoint != nil {
+		loggingState.gitlabStartOffset = checkpoint.Offset
+		loggingState.lastLogLineTimestamp = checkpoint.LastTimestamp
+	}
+
+	labLog := newGitLabTraceLogger(loggingState)
 
 	backChannel := gitLabBackChannel{
 		httpSession:    httpSession,
@@ -80,24 +157,75 @@ func monitorJob(job *k.Job, httpSession *protocol.RunnerHttpSession, jobId int,
 		localLogger:    ctxLogger,
 	}
 
+	// Detached job keeps running in K8S until the runner is back
+	detached := false
 	defer func() {
-		ctxLogger.Infof("Deleting job %v", job.Name)
+		if detached {
+			ctxLogger.Infof("Detached from job %v", job.Name())
+			return
+		}
+
+		ctxLogger.Infof("Deleting job %v", job.Name())
 		err := job.Delete()
 		if err != nil {
+			metrics.K8SErrors.WithLabelValues(metrics.OpDeleteJob).Inc()
 			ctxLogger.Error(err)
 		}
 	}()
 
+	saveCheckpoint := func(cp executor.TraceCheckpoint) {
+		err := job.SaveTraceCheckpoint(cp)
+		if err != nil {
+			metrics.K8SErrors.WithLabelValues(metrics.OpSaveCheckpoint).Inc()
+			ctxLogger.Warn(err)
+		}
+	}
+
+	// The checkpoint follows every acknowledged PATCH, the resumed job must not write the trace twice
 	logPush := func() {
 		<-tickGitLabLog.C
-		err := pushLogsToGitlab(loggingState, &backChannel)
+		cp, err := pushLogsToGitlab(loggingState, &backChannel)
 		if err != nil {
 			ctxLogger.Warn(err)
+			return
+		}
+
+		if cp != nil {
+			saveCheckpoint(*cp)
 		}
 	}
 
-	// The error can be ignored for pending status,
-	_, _ = backChannel.syncJobStatus(protocol.Pending)
+	// Log stream of the builder pod
+	var follower *logFollower
+	defer func() {
+		if follower != nil {
+			follower.abort()
+		}
+	}()
+
+	// The last push must include the rest of the log and the text held back by the masker
+	finalLogPush := func() {
+		if follower != nil {
+			follower.finish()
+		}
+
+		err := loggingState.flush()
+		if err != nil {
+			ctxLogger.Warn(err)
+		}
+		logPush()
+	}
+
+	if checkpoint == nil {
+		// The error can be ignored for pending status,
+		_, _ = backChannel.syncJobStatus(protocol.Pending)
+	} else {
+		labLog.Info("The runner was restarted, resuming the job")
+	}
+
+	// Status changes pushed by the executor
+	statusChanged, unsubscribe := job.Subscribe()
+	defer unsubscribe()
 
 	// Rate limiter for this routine
 	tickJobState := time.NewTicker(1 * time.Second)
@@ -106,92 +234,132 @@ func monitorJob(job *k.Job, httpSession *protocol.RunnerHttpSession, jobId int,
 	logPushTimer := time.NewTicker(1 * time.Second)
 	defer logPushTimer.Stop()
 
-	for {
-		select {
-
-		case <-tickJobState.C:
-			status, err := job.GetK8SJobStatus()
-			if err != nil {
-				ctxLogger.Warn(err)
-				labLog.Warnf("%s %s", err, podsInfoMessage(status.Pods))
-				continue
-			}
+	// The job has been seen by the executor
+	jobSeen := false
+
+	// Pending time is observed once, when the builder starts
+	pendingObserved := false
+
+	// Check the job status. Returns true when the monitoring is over.
+	// Gitlab is synced and pending state is reported only on periodic checks
+	handleStatus := func(periodic bool) bool {
+		status, err := job.Status()
+		switch {
+		case err == executor.ErrJobNotFound && jobSeen:
+			msg := fmt.Sprintf("Job %s was deleted", job.Name())
+			ctxLogger.Warn(msg)
+			labLog.Error(msg)
+			finalLogPush()
+			syncJobStateLoop(&backChannel, jobResult{state: protocol.Failed, failureReason: protocol.RunnerSystemFailure}, ctxLogger)
+			metrics.JobFinished(projectId, metrics.StatusFailed, time.Time{})
+			return true
+
+		case err == executor.ErrJobNotFound:
+			// new job may not be in the cache yet
+			ctxLogger.Debug(err)
+			return false
+
+		case err != nil:
+			ctxLogger.Warn(err)
+			labLog.Warn(err)
+			return false
+		}
+		jobSeen = true
 
-			// Handle jobs canceled by gitlab
-			gitlabStatus, err := backChannel.syncJobStatus(protocol.Running)
+		// Handle jobs canceled by gitlab
+		if periodic {
+			gitlabStatus, _ := backChannel.syncJobStatus(protocol.Running)
 			switch {
 			case gitlabStatus == nil:
 				ctxLogger.Warn("gitlab job status is nil")
-				continue
+				return false
 			case gitlabStatus.StatusCode == http.StatusForbidden:
 				ctxLogger.Info("job canceled")
-				return
+				metrics.JobFinished(projectId, metrics.StatusCanceled, status.Created)
+				return true
 			case gitlabStatus.StatusCode != http.StatusOK:
 				ctxLogger.Warnf("unknown gitlab status response code '%d', msg '%s'", gitlabStatus.StatusCode, gitlabStatus.RemoteState)
-				continue
+				return false
 			}
+		}
 
-			js := status.Job.Status
-
-			// The pod must be not in pending or unknown state to have logs
-			builderPhase := status.PodPhases[k.ContainerNameBuilder]
-			if builderPhase == v1.PodRunning || builderPhase == v1.PodSucceeded || builderPhase == v1.PodFailed {
-				// find pod for builder
-				//noinspection GoShadowedVar
-				podName, err := findPodOfContainer(status.Pods, k.ContainerNameBuilder)
-				if err != nil {
-					ctxLogger.Warn(err)
-					labLog.Warnf("%s %s", err, podsInfoMessage(status.Pods))
-					continue
-				}
+		if len(status.LogSource) > 0 {
+			// resumed jobs were pending before the restart
+			if !pendingObserved && checkpoint == nil {
+				metrics.PodPendingDuration.Observe(time.Since(status.Created).Seconds())
+			}
+			pendingObserved = true
 
-				// Fetch logs from K8S
-				err = loggingState.bufferLogs(job, podName)
-				if err != nil {
-					ctxLogger.Warn(err)
-					labLog.Warnf("%s %s", err, podsInfoMessage(status.Pods))
-					continue
+			// Follow logs of the current builder
+			if follower == nil || follower.source != status.LogSource {
+				if follower != nil {
+					go follower.finish()
 				}
-			} else if builderPhase == v1.PodPending {
-				podInfo := podsInfoMessage(status.Pods)
-				labLog.Infof("PENDING %s", podInfo)
+				follower = loggingState.followLogs(job, status.LogSource)
 			}
+		} else if status.State == executor.JobPending && periodic && len(status.Info) > 0 {
+			labLog.Infof("PENDING %s", status.Info)
+		}
 
-			isFailure, failureCond := checkJobConditions(js.Conditions, v12.JobFailed)
-			isSuccess, successCond := checkJobConditions(js.Conditions, v12.JobComplete)
+		switch status.State {
+		case executor.JobFailed:
+			duration := renderJobDuration(status)
+			msg := fmt.Sprintf("Job Failed %s, reason %s, exit code %d. %s", duration, status.FailureReason, status.ExitCode, status.Info)
 
-			switch {
-			case isFailure:
-				duration := renderJobDuration(&js)
-				msg := fmt.Sprintf("Job Failed %s. %s", duration, podsInfoMessage(status.Pods))
+			ctxLogger.Warn(msg)
+			labLog.Error(msg)
+
+			if len(status.Details) > 0 {
+				ctxLogger.Warn(status.Details)
+				labLog.Error(status.Details)
+			}
 
-				ctxLogger.Warn(msg)
-				labLog.Error(msg)
+			finalLogPush()
+			syncJobStateLoop(&backChannel, jobResult{state: protocol.Failed, failureReason: status.FailureReason, exitCode: status.ExitCode}, ctxLogger)
+			metrics.JobFinished(projectId, metrics.StatusFailed, status.Created)
+			return true
 
-				if failureCond != nil {
-					inf := renderJson(failureCond)
-					ctxLogger.Warn(inf)
-					labLog.Error(inf)
-				}
+		case executor.JobSucceeded:
+			duration := renderJobDuration(status)
+			msg := fmt.Sprintf("OK: duration %s. %s", duration, status.Info)
+			ctxLogger.Info(msg)
+			labLog.Info(msg)
 
-				logPush()
-				syncJobStateLoop(&backChannel, protocol.Failed, ctxLogger)
-				return
+			if len(status.Details) > 0 {
+				ctxLogger.Info(status.Details)
+				labLog.Info(status.Details)
+			}
 
-			case isSuccess:
-				duration := renderJobDuration(&js)
-				msg := fmt.Sprintf("OK: duration %s. %s", duration, podsInfoMessage(status.Pods))
-				ctxLogger.Info(msg)
-				labLog.Info(msg)
+			finalLogPush()
+			syncJobStateLoop(&backChannel, jobResult{state: protocol.Success}, ctxLogger)
+			metrics.JobFinished(projectId, metrics.StatusSuccess, status.Created)
+			return true
+		}
 
-				if successCond != nil {
-					inf := renderJson(successCond)
-					ctxLogger.Info(inf)
-					labLog.Info(inf)
-				}
+		return false
+	}
+
+	// Fail the job which is left by the runner, it is deleted on return
+	abort := func(msg string) {
+		ctxLogger.Warn(msg)
+		labLog.Error(msg)
+		if follower != nil {
+			follower.abort()
+		}
+		finalLogPush()
+		syncJobStateLoop(&backChannel, jobResult{state: protocol.Failed, failureReason: protocol.RunnerSystemFailure}, ctxLogger)
+		metrics.JobFinished(projectId, metrics.StatusFailed, time.Time{})
+	}
+
+	for {
+		select {
+		case <-statusChanged:
+			if handleStatus(false) {
+				return
+			}
 
-				logPush()
-				syncJobStateLoop(&backChannel, protocol.Success, ctxLogger)
+		case <-tickJobState.C:
+			if handleStatus(true) {
 				return
 			}
 
@@ -200,10 +368,26 @@ func monitorJob(job *k.Job, httpSession *protocol.RunnerHttpSession, jobId int,
 			logPush()
 
 		case <-stopChan:
-			// the runner is killed
-			labLog.Error("The runner was killed")
-			logPush()
-			syncJobStateLoop(&backChannel, protocol.Failed, ctxLogger)
+			if !job.Resumable() {
+				abort("The runner is stopping and the job can not be resumed")
+				return
+			}
+
+			// the runner is stopping, the executor finishes the job and the next instance of the runner resumes it
+			labLog.Warn("The runner is stopping. The job keeps running and will be resumed when the runner is back")
+			if follower != nil {
+				follower.abort()
+			}
+			finalLogPush()
+			if cp, ok := loggingState.checkpoint(); ok {
+				saveCheckpoint(cp)
+			}
+			detached = true
+			return
+
+		case <-killChan:
+			// the runner gave up draining
+			abort("The runner was killed")
 			return
 		}
 	}
@@ -211,14 +395,11 @@ func monitorJob(job *k.Job, httpSession *protocol.RunnerHttpSession, jobId int,
 }
 
 // make human readable job duration
-func renderJobDuration(jobStatus *v12.JobStatus) string {
+func renderJobDuration(status *executor.JobStatus) string {
 	strDuration := ""
 
-	if jobStatus.StartTime != nil && jobStatus.CompletionTime != nil {
-		start := jobStatus.StartTime.Time
-		end := jobStatus.CompletionTime.Time
-
-		dur := end.Sub(start)
+	if !status.Started.IsZero() && !status.Finished.IsZero() {
+		dur := status.Finished.Sub(status.Started)
 		strDuration = dur.String()
 	}
 
@@ -242,7 +423,7 @@ func renderJson(obj interface{}) string {
 	return string(render)
 }
 
-func syncJobStateLoop(backChannel *gitLabBackChannel, state protocol.JobState, ctxLogger *logrus.Entry) {
+func syncJobStateLoop(backChannel *gitLabBackChannel, result jobResult, ctxLogger *logrus.Entry) {
 	loopTicker := time.NewTicker(time.Second)
 	defer loopTicker.Stop()
 	var retries = 5
@@ -252,7 +433,7 @@ func syncJobStateLoop(backChannel *gitLabBackChannel, state protocol.JobState, c
 
 		select {
 		case <-loopTicker.C:
-			_, err := backChannel.syncJobStatus(state)
+			_, err := backChannel.syncJobResult(result)
 			if err != nil {
 				ctxLogger.Warn(err)
 			} else {
@@ -263,7 +444,8 @@ func syncJobStateLoop(backChannel *gitLabBackChannel, state protocol.JobState, c
 
 }
 
-func pushLogsToGitlab(logState *logState, backChannel *gitLabBackChannel) error {
+// Returns the trace checkpoint after the acknowledged PATCH. Nil if there was nothing to push
+func pushLogsToGitlab(logState *logState, backChannel *gitLabBackChannel) (*executor.TraceCheckpoint, error) {
 	logState.logBufferMux.Lock()
 	defer logState.logBufferMux.Unlock()
 
@@ -275,7 +457,7 @@ func pushLogsToGitlab(logState *logState, backChannel *gitLabBackChannel) error
 				logState.gitlabStartOffset = contentRange.End
 			}
 
-			return err
+			return nil, err
 		} else {
 			// update next offset
 			if contentRange == nil {
@@ -286,10 +468,15 @@ func pushLogsToGitlab(logState *logState, backChannel *gitLabBackChannel) error
 
 			// reset buffer
 			logState.logBuffer.Reset()
+
+			return &executor.TraceCheckpoint{
+				Offset:        logState.gitlabStartOffset,
+				LastTimestamp: logState.lastLogLineTimestamp,
+			}, nil
 		}
 	}
 
-	return nil
+	return nil, nil
 }
 
 func podsInfoMessage(pods []v1.Pod) string {
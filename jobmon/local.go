@@ -0,0 +1,313 @@
+package jobmon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sisyphus/cache"
+	"sisyphus/executor"
+	k "sisyphus/kubernetes"
+	"sisyphus/protocol"
+	"sisyphus/shell"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the log file of a running local job is checked for new lines
+const localLogPollInterval = 200 * time.Millisecond
+
+// Time given to a stopped script to finish, it fails after the always steps and a pause of 10 seconds
+const localKillGracePeriod = 20 * time.Second
+
+// Runs the job scripts as processes of the runner host, in temporary directories under buildDir.
+// Meant for development against a gitlab stand-in: images and services are ignored,
+// the tools used by the jobs must be installed on the host. K8S job parameters are ignored.
+// Local jobs are not resumed, they are killed when the runner stops and the monitor fails them
+type localExecutor struct {
+	buildDir string
+	stopChan <-chan bool
+}
+
+func NewLocalExecutor(buildDir string, stopChan <-chan bool) executor.Executor {
+	return &localExecutor{
+		buildDir: buildDir,
+		stopChan: stopChan,
+	}
+}
+
+func (e *localExecutor) CreateJob(spec *protocol.JobSpec, _ *executor.JobParameters, cacheSettings *cache.Settings) (executor.Job, error) {
+	err := os.MkdirAll(e.buildDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(e.buildDir, k.JobNamePrefix(spec))
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := startLocalJob(dir, spec, cacheSettings, e.stopChan)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Job script running as a local process
+type localJob struct {
+	dir     string
+	logPath string
+	cmd     *exec.Cmd
+	created time.Time
+
+	// Notified when the process exits
+	changed chan struct{}
+	// Closed when the process exits
+	done chan struct{}
+
+	mux      sync.Mutex
+	finished time.Time
+	exitCode int
+	deleted  bool
+}
+
+func startLocalJob(dir string, spec *protocol.JobSpec, cacheSettings *cache.Settings, stopChan <-chan bool) (*localJob, error) {
+	script, err := shell.GenerateScriptInDir(spec, cacheSettings, filepath.Join(dir, "build"))
+	if err != nil {
+		return nil, err
+	}
+
+	scriptPath := filepath.Join(dir, "entrypoint.sh")
+	err = ioutil.WriteFile(scriptPath, []byte(script.Text), os.FileMode(k.ConfigMapAccessMode))
+	if err != nil {
+		return nil, err
+	}
+
+	logPath := filepath.Join(dir, "job.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same writer for both outputs, so lines are not interleaved
+	out := &timestampWriter{out: logFile, lineStart: true}
+
+	cmd := exec.Command(scriptPath)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for _, v := range spec.Variables {
+		cmd.Env = append(cmd.Env, v.Key+"="+v.Value)
+	}
+	for name, val := range script.SecretEnv {
+		cmd.Env = append(cmd.Env, name+"="+val)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	// Own process group, so the steps running in background are killed with the script
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		_ = logFile.Close()
+		return nil, err
+	}
+
+	job := &localJob{
+		dir:     dir,
+		logPath: logPath,
+		cmd:     cmd,
+		created: time.Now(),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	go job.wait(logFile)
+	go func() {
+		select {
+		case <-stopChan:
+			job.kill()
+		case <-job.done:
+		}
+	}()
+
+	return job, nil
+}
+
+func (j *localJob) wait(logFile *os.File) {
+	_ = j.cmd.Wait()
+	_ = logFile.Close()
+
+	j.mux.Lock()
+	j.finished = time.Now()
+	j.exitCode = j.cmd.ProcessState.ExitCode()
+	j.mux.Unlock()
+
+	close(j.done)
+	select {
+	case j.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Stop the script like the kubelet stops the pod. The script stops its step, which runs in own process group,
+// and runs the always steps. The process group of the script is killed after the grace period
+func (j *localJob) kill() {
+	_ = syscall.Kill(-j.cmd.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case <-j.done:
+	case <-time.After(localKillGracePeriod):
+		_ = syscall.Kill(-j.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func (j *localJob) isDone() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *localJob) Name() string {
+	return filepath.Base(j.dir)
+}
+
+func (j *localJob) Status() (*executor.JobStatus, error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.deleted {
+		return nil, executor.ErrJobNotFound
+	}
+
+	result := &executor.JobStatus{
+		State:     executor.JobRunning,
+		LogSource: j.logPath,
+		Created:   j.created,
+		Started:   j.created,
+		Finished:  j.finished,
+		Info:      fmt.Sprintf("[pid=%d dir='%s']", j.cmd.Process.Pid, j.dir),
+	}
+
+	switch {
+	case j.finished.IsZero():
+		// still running
+	case j.exitCode == 0:
+		result.State = executor.JobSucceeded
+	case j.exitCode > 0:
+		result.State = executor.JobFailed
+		result.FailureReason = protocol.ScriptFailure
+		result.ExitCode = j.exitCode
+	default:
+		// killed by signal
+		result.State = executor.JobFailed
+		result.FailureReason = protocol.RunnerSystemFailure
+		result.Details = j.cmd.ProcessState.String()
+	}
+
+	return result, nil
+}
+
+func (j *localJob) Subscribe() (<-chan struct{}, func()) {
+	return j.changed, func() {}
+}
+
+func (j *localJob) StreamLog(source string, _ *time.Time) (io.ReadCloser, error) {
+	file, err := os.Open(source)
+	if os.IsNotExist(err) {
+		return nil, executor.ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &logFileFollower{file: file, job: j, closed: make(chan struct{})}, nil
+}
+
+// Local jobs are not resumed
+func (j *localJob) Resumable() bool {
+	return false
+}
+
+func (j *localJob) SaveTraceCheckpoint(_ executor.TraceCheckpoint) error {
+	return nil
+}
+
+func (j *localJob) Delete() error {
+	if !j.isDone() {
+		j.kill()
+		<-j.done
+	}
+
+	j.mux.Lock()
+	j.deleted = true
+	j.mux.Unlock()
+
+	return os.RemoveAll(j.dir)
+}
+
+// Reads the log file of the job until the job exits
+type logFileFollower struct {
+	file      *os.File
+	job       *localJob
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (f *logFileFollower) Read(p []byte) (int, error) {
+	for {
+		// the last lines are written before the job is done
+		done := f.job.isDone()
+
+		n, err := f.file.Read(p)
+		if n > 0 || err != io.EOF || done {
+			return n, err
+		}
+
+		select {
+		case <-f.closed:
+			return 0, io.EOF
+		case <-f.job.done:
+		case <-time.After(localLogPollInterval):
+		}
+	}
+}
+
+func (f *logFileFollower) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return f.file.Close()
+}
+
+// Prefixes each line with timestamp in the format of K8S pod logs
+type timestampWriter struct {
+	out       io.Writer
+	lineStart bool
+}
+
+func (w *timestampWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, b := range p {
+		if w.lineStart {
+			buf.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+			buf.WriteByte(' ')
+		}
+		buf.WriteByte(b)
+		w.lineStart = b == '\n'
+	}
+
+	_, err := w.out.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,181 @@
+package jobmon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sisyphus/executor"
+	"sisyphus/protocol"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runLocalJob(t *testing.T, script ...string) (*executor.JobStatus, string) {
+	buildDir, err := ioutil.TempDir("", "sisyphus-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(buildDir)
+
+	spec := &protocol.JobSpec{
+		Id: 42,
+		JobInfo: protocol.JobInfo{
+			ProjectId: 7,
+		},
+		Variables: []protocol.JobVariable{
+			{Key: "GIT_STRATEGY", Value: "none"},
+			{Key: "GREETING", Value: "hello"},
+		},
+		Steps: []protocol.JobStep{
+			{Name: "script", Script: script, When: protocol.WhenOnSuccess},
+		},
+	}
+
+	job, err := NewLocalExecutor(buildDir, make(chan bool)).CreateJob(spec, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	select {
+	case <-changed:
+	case <-time.After(30 * time.Second):
+		t.Fatal("job did not finish")
+	}
+
+	status, err := job.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := job.StreamLog(status.LogSource, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+
+	err = job.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = job.Status(); err != executor.ErrJobNotFound {
+		t.Errorf("deleted job is found: %v", err)
+	}
+
+	return status, string(log)
+}
+
+func TestLocalExecutor(t *testing.T) {
+	status, log := runLocalJob(t, "echo \"${GREETING} world\"")
+	if status.State != executor.JobSucceeded {
+		t.Errorf("expected success, got %+v", status)
+	}
+
+	found := false
+	for _, line := range strings.Split(log, "\n") {
+		parsed, err := parseLogLine(line)
+		if err == nil && parsed.text == "hello world" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("job output with timestamp not found in log:\n%s", log)
+	}
+
+	status, _ = runLocalJob(t, "exit 3")
+	if status.State != executor.JobFailed || status.FailureReason != protocol.ScriptFailure || status.ExitCode != 3 {
+		t.Errorf("expected script failure with exit code 3, got %+v", status)
+	}
+}
+
+// Local jobs can not be resumed, they are failed and deleted when the runner stops
+func TestLocalExecutor_stop(t *testing.T) {
+	var mux sync.Mutex
+	var states []protocol.UpdateJobStateRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var request protocol.UpdateJobStateRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			mux.Lock()
+			states = append(states, request)
+			mux.Unlock()
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	httpSession, err := protocol.NewHttpSession(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildDir, err := ioutil.TempDir("", "sisyphus-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(buildDir)
+
+	spec := &protocol.JobSpec{
+		Id:        42,
+		Token:     "token",
+		JobInfo:   protocol.JobInfo{ProjectId: 7},
+		Variables: []protocol.JobVariable{{Key: "GIT_STRATEGY", Value: "none"}},
+		Steps:     []protocol.JobStep{{Name: "script", Script: []string{"sleep 60"}, When: protocol.WhenOnSuccess}},
+	}
+
+	stopChan := make(chan bool)
+	tickGitLabLog := time.NewTicker(10 * time.Millisecond)
+	defer tickGitLabLog.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunJob(spec, NewLocalExecutor(buildDir, stopChan), &executor.JobParameters{}, httpSession, nil, stopChan, make(chan bool), tickGitLabLog)
+	}()
+
+	time.Sleep(2 * time.Second)
+	close(stopChan)
+
+	select {
+	case <-done:
+	case <-time.After(60 * time.Second):
+		t.Fatal("job monitor did not stop")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	last := states[len(states)-1]
+	if last.State != protocol.Failed || last.FailureReason != protocol.RunnerSystemFailure {
+		t.Errorf("expected runner system failure, got %+v", last)
+	}
+
+	dirs, err := ioutil.ReadDir(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 0 {
+		t.Errorf("job dir is not deleted: %v", dirs[0].Name())
+	}
+}
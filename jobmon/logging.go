@@ -2,11 +2,10 @@ package jobmon
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"regexp"
-	k "sisyphus/kubernetes"
+	"hash/fnv"
+	"sisyphus/executor"
 	"strings"
 	"sync"
 	"time"
@@ -20,133 +19,117 @@ type LogLine struct {
 type logState struct {
 	lastLogLineTimestamp *time.Time
 
-	// Memory of previous lines
+	// Hashes of printed lines with the last timestamp
 	previousLineHash []uint64
 	localLogger      *logrus.Entry
 
 	logBuffer    *bytes.Buffer
 	logBufferMux sync.Mutex
 
+	// Masks secrets before they reach logBuffer
+	masker *secretMasker
+
 	gitlabStartOffset int
-	lineBreakRegexp   *regexp.Regexp
 }
 
 const (
-	LogFetchTimeout        = 10 * time.Second
+	// Time given to the log stream to deliver the rest of the log of finished job
+	LogFetchTimeout = 10 * time.Second
+
+	// Delay before the log stream is opened again
+	LogReconnectDelay = 1 * time.Second
+
 	PreviousLineMemorySize = 10240
 )
 
-func (ls *logState) bufferLogs(job *k.Job, podName string) error {
-	// Fetch logs with timeout
-	chChunk := make(chan *bytes.Buffer, 1)
-	chErr := make(chan error, 1)
+// Print one line of the pod log to the gitlab buffer. Lines replayed after reconnect are skipped.
+// Occurrences count identical lines of the current stream, so repeated lines with the same timestamp are kept
+func (ls *logState) printLine(rawLine string, occurrences map[uint64]int) error {
+	trimmed := strings.TrimSpace(rawLine)
+	if len(trimmed) == 0 {
+		return nil
+	}
 
-	go func() {
-		rdr, err := job.GetPodLog(podName, ls.lastLogLineTimestamp)
+	line, err := parseLogLine(trimmed)
+	if err != nil {
+		ls.localLogger.Debugf("skipping log line without timestamp: %v", err)
+		return nil
+	}
 
-		if err != nil {
-			chErr <- err
-			return
-		}
-		chChunk <- rdr
-	}()
+	hash := lineHash(line)
+	occurrence := occurrences[hash]
+	occurrences[hash] = occurrence + 1
+	hash = hash ^ uint64(occurrence)
 
-	select {
-	case chunk := <-chChunk:
-		err := ls.printLog(chunk)
-		return err
+	ls.logBufferMux.Lock()
+	defer ls.logBufferMux.Unlock()
 
-	case err := <-chErr:
-		return err
+	if ls.lastLogLineTimestamp != nil {
+		switch {
+		case line.timestamp.Before(*ls.lastLogLineTimestamp):
+			return nil
+
+		case line.timestamp.Equal(*ls.lastLogLineTimestamp):
+			for _, h := range ls.previousLineHash {
+				if h == hash {
+					return nil
+				}
+			}
+
+		default:
+			ls.previousLineHash = ls.previousLineHash[:0]
+		}
+	}
 
-	case <-time.After(LogFetchTimeout):
-		return errors.New("fetching of logs from k8s timed out")
+	// Lines with the last timestamp are remembered
+	if len(ls.previousLineHash) < PreviousLineMemorySize {
+		ls.previousLineHash = append(ls.previousLineHash, hash)
 	}
-}
+	ls.lastLogLineTimestamp = &line.timestamp
 
-func (ls *logState) printLog(logChunk *bytes.Buffer) error {
+	_, err = fmt.Fprintln(ls.masker, line.text)
+	return err
+}
 
-	// Filter trimLines
-	tmpLines := ls.lineBreakRegexp.Split(logChunk.String(), -1)
-	trimLines := make([]string, 0, len(tmpLines))
-	for _, l := range tmpLines {
-		trimmed := strings.TrimSpace(l)
-		if len(trimmed) > 0 {
-			trimLines = append(trimLines, trimmed)
-		}
-	}
+// Write to gitlab trace buffer, secrets are masked
+func (ls *logState) Write(p []byte) (int, error) {
+	ls.logBufferMux.Lock()
+	defer ls.logBufferMux.Unlock()
 
-	// Parse trimLines
-	parsedLines := parseLogLines(trimLines)
+	return ls.masker.Write(p)
+}
 
-	// filter already printed lines
-	var filteredLines []LogLine
-	if ls.lastLogLineTimestamp != nil {
-		filteredLines = keepLinesAfter(parsedLines, *ls.lastLogLineTimestamp)
-	} else {
-		filteredLines = parsedLines
-	}
+// Release the text held back by the masker. Called before the last push to gitlab
+func (ls *logState) flush() error {
+	ls.logBufferMux.Lock()
+	defer ls.logBufferMux.Unlock()
 
-	// Remember last timestamp
-	if len(filteredLines) > 0 {
-		ls.lastLogLineTimestamp = &filteredLines[len(filteredLines)-1].timestamp
-	}
+	return ls.masker.Flush()
+}
 
-	// print lines to gitlab buffer
+// Trace progress. Valid only when everything buffered was pushed to gitlab
+func (ls *logState) checkpoint() (executor.TraceCheckpoint, bool) {
 	ls.logBufferMux.Lock()
 	defer ls.logBufferMux.Unlock()
 
-	for _, l := range filteredLines {
-		_, err := fmt.Fprintln(ls.logBuffer, l.text)
-		if err != nil {
-			return err
-		}
+	cp := executor.TraceCheckpoint{
+		Offset:        ls.gitlabStartOffset,
+		LastTimestamp: ls.lastLogLineTimestamp,
 	}
 
-	return nil
+	return cp, ls.logBuffer.Len() == 0
 }
 
-func newLogState(localLogger *logrus.Entry) *logState {
+func newLogState(localLogger *logrus.Entry, secrets []string) *logState {
 	var logBuff bytes.Buffer
 	return &logState{
 		lastLogLineTimestamp: nil,
 		logBuffer:            &logBuff,
+		masker:               newSecretMasker(&logBuff, secrets),
 		gitlabStartOffset:    0,
 		localLogger:          localLogger,
 		previousLineHash:     make([]uint64, 0, PreviousLineMemorySize),
-		lineBreakRegexp:      regexp.MustCompile("\r?\n"),
-	}
-}
-
-// Keep only lines newer than a timestamp
-func keepLinesAfter(lines []LogLine, minTime time.Time) []LogLine {
-	for threshold, p := range lines {
-		if p.timestamp.After(minTime) {
-			return lines[threshold:]
-		}
-	}
-
-	return nil
-}
-
-// Parse timestamps in multiple log lines
-func parseLogLines(rawLines []string) []LogLine {
-	if len(rawLines) == 0 {
-		return nil
 	}
-
-	result := make([]LogLine, 0, len(rawLines))
-
-	for _, raw := range rawLines {
-		p, err := parseLogLine(raw)
-		if err != nil {
-			continue
-		} else {
-			result = append(result, *p)
-		}
-	}
-
-	return result
 }
 
 // Split log line to timestamp and text
@@ -167,3 +150,11 @@ func parseLogLine(logLine string) (*LogLine, error) {
 		text:      lineTxt,
 	}, nil
 }
+
+// Hash of timestamp and text of the line
+func lineHash(line *LogLine) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(line.timestamp.Format(time.RFC3339Nano)))
+	_, _ = h.Write([]byte(line.text))
+	return h.Sum64()
+}
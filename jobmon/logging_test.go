@@ -0,0 +1,125 @@
+package jobmon
+
+import (
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"sisyphus/protocol"
+	"testing"
+	"time"
+)
+
+func TestLogState_printLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams [][]string
+		want    string
+	}{
+		{
+			name: "lines with the same timestamp",
+			streams: [][]string{{
+				"2019-11-20T10:00:00.000000001Z first\n",
+				"2019-11-20T10:00:00.000000001Z second\n",
+				"2019-11-20T10:00:00.000000001Z second\n",
+			}},
+			want: "first\nsecond\nsecond\n",
+		},
+		{
+			name: "reconnect replays the last second",
+			streams: [][]string{
+				{
+					"2019-11-20T10:00:00.1Z one\n",
+					"2019-11-20T10:00:00.2Z two\n",
+					"2019-11-20T10:00:00.2Z two\n",
+				},
+				{
+					"2019-11-20T10:00:00.1Z one\n",
+					"2019-11-20T10:00:00.2Z two\n",
+					"2019-11-20T10:00:00.2Z two\n",
+					"2019-11-20T10:00:00.2Z two\n",
+					"2019-11-20T10:00:01Z three\n",
+				},
+			},
+			want: "one\ntwo\ntwo\ntwo\nthree\n",
+		},
+		{
+			name: "lines without timestamp are skipped",
+			streams: [][]string{{
+				"garbage\n",
+				"\n",
+				"2019-11-20T10:00:00Z ok\n",
+			}},
+			want: "ok\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := newLogState(logrus.NewEntry(logrus.New()), nil)
+
+			for _, stream := range tt.streams {
+				occurrences := make(map[uint64]int)
+				for _, line := range stream {
+					if err := ls.printLine(line, occurrences); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			if err := ls.flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := ls.logBuffer.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The checkpoint follows the offset acknowledged by gitlab
+func Test_pushLogsToGitlab(t *testing.T) {
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Range", "0-11")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	httpSession, err := protocol.NewHttpSession(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := newLogState(logrus.NewEntry(logrus.New()), nil)
+	backChannel := &gitLabBackChannel{httpSession: httpSession, jobId: 42, gitlabJobToken: "token"}
+
+	cp, err := pushLogsToGitlab(ls, backChannel)
+	if err != nil || cp != nil {
+		t.Fatalf("expected no checkpoint for empty buffer, got %+v, %v", cp, err)
+	}
+
+	if err := ls.printLine("2019-11-20T10:00:00Z first line\n", map[uint64]int{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	status = http.StatusServiceUnavailable
+	cp, err = pushLogsToGitlab(ls, backChannel)
+	if err == nil || cp != nil {
+		t.Fatalf("expected no checkpoint for failed push, got %+v, %v", cp, err)
+	}
+
+	status = http.StatusAccepted
+	cp, err = pushLogsToGitlab(ls, backChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+	if cp == nil || cp.Offset != 11 || cp.LastTimestamp == nil || !cp.LastTimestamp.Equal(ts) {
+		t.Errorf("unexpected checkpoint %+v", cp)
+	}
+}
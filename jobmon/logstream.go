@@ -0,0 +1,151 @@
+package jobmon
+
+import (
+	"bufio"
+	"io"
+	"sisyphus/executor"
+	"sisyphus/metrics"
+	"sync"
+	"time"
+)
+
+// Follows the builder log of one source, e.g. pod, and prints it to the gitlab buffer.
+// The stream is opened again when it ends, until the follower is finished
+type logFollower struct {
+	logState *logState
+	job      executor.Job
+	source   string
+
+	// Closed when the rest of the log is requested
+	finishing chan struct{}
+	// Closed when the goroutine exits
+	done chan struct{}
+
+	finishOnce sync.Once
+	streamMux  sync.Mutex
+	stream     io.ReadCloser
+	aborted    bool
+}
+
+// Start following the log of the source
+func (ls *logState) followLogs(job executor.Job, source string) *logFollower {
+	f := &logFollower{
+		logState:  ls,
+		job:       job,
+		source:    source,
+		finishing: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go f.run()
+	return f
+}
+
+func (f *logFollower) run() {
+	defer close(f.done)
+
+	for {
+		err := f.streamOnce()
+
+		f.streamMux.Lock()
+		aborted := f.aborted
+		f.streamMux.Unlock()
+
+		switch {
+		case aborted:
+			return
+
+		case err == executor.ErrJobNotFound:
+			f.logState.localLogger.Infof("Log source %s is gone, stopped following it", f.source)
+			return
+
+		case err != nil:
+			metrics.K8SErrors.WithLabelValues(metrics.OpStreamLog).Inc()
+			f.logState.localLogger.Warnf("Log stream of %s failed: %v", f.source, err)
+
+		case f.isFinishing():
+			// the stream of terminated container ends after the last line
+			return
+		}
+
+		select {
+		case <-f.finishing:
+		case <-time.After(LogReconnectDelay):
+		}
+	}
+}
+
+// Read the stream until it ends. Returns nil at the end of the stream
+func (f *logFollower) streamOnce() error {
+	ls := f.logState
+
+	ls.logBufferMux.Lock()
+	since := ls.lastLogLineTimestamp
+	ls.logBufferMux.Unlock()
+
+	stream, err := f.job.StreamLog(f.source, since)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer stream.Close()
+
+	f.streamMux.Lock()
+	if f.aborted {
+		f.streamMux.Unlock()
+		return nil
+	}
+	f.stream = stream
+	f.streamMux.Unlock()
+
+	occurrences := make(map[uint64]int)
+	reader := bufio.NewReader(stream)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return ls.printLine(line, occurrences)
+		} else if err != nil {
+			// incomplete line is read again after reconnect
+			return err
+		}
+
+		err = ls.printLine(line, occurrences)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *logFollower) isFinishing() bool {
+	select {
+	case <-f.finishing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for the rest of the log of the terminated container. The stream is aborted after LogFetchTimeout
+func (f *logFollower) finish() {
+	f.finishOnce.Do(func() { close(f.finishing) })
+
+	select {
+	case <-f.done:
+	case <-time.After(LogFetchTimeout):
+		f.logState.localLogger.Warnf("Log of %s was not complete in %s", f.source, LogFetchTimeout)
+		f.abort()
+	}
+}
+
+// Stop following the log immediately
+func (f *logFollower) abort() {
+	f.finishOnce.Do(func() { close(f.finishing) })
+
+	f.streamMux.Lock()
+	defer f.streamMux.Unlock()
+
+	f.aborted = true
+	if f.stream != nil {
+		_ = f.stream.Close()
+	}
+}
@@ -0,0 +1,117 @@
+package jobmon
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+const MaskedValue = "[MASKED]"
+
+// Streaming redaction of secrets in the job trace.
+// A secret may be split between two writes, so the tail of the stream which could be
+// the beginning of a secret is held back until the next write or flush.
+// The held back data is not masked yet, a longer secret may still match it.
+type secretMasker struct {
+	out      io.Writer
+	secrets  [][]byte
+	replacer *strings.Replacer
+	pending  []byte
+}
+
+func newSecretMasker(out io.Writer, secrets []string) *secretMasker {
+	// Longer secrets first, so that a secret containing another one is masked as a whole
+	sorted := make([]string, 0, len(secrets))
+	seen := make(map[string]bool)
+	for _, s := range secrets {
+		if len(s) > 0 && !seen[s] {
+			seen[s] = true
+			sorted = append(sorted, s)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	oldNew := make([]string, 0, 2*len(sorted))
+	byteSecrets := make([][]byte, 0, len(sorted))
+	for _, s := range sorted {
+		oldNew = append(oldNew, s, MaskedValue)
+		byteSecrets = append(byteSecrets, []byte(s))
+	}
+
+	return &secretMasker{
+		out:      out,
+		secrets:  byteSecrets,
+		replacer: strings.NewReplacer(oldNew...),
+	}
+}
+
+func (m *secretMasker) Write(p []byte) (int, error) {
+	if len(m.secrets) == 0 {
+		return m.out.Write(p)
+	}
+
+	data := append(m.pending, p...)
+	cut := m.safeCut(data, len(data)-m.partialSecretSuffix(data))
+	m.pending = append([]byte(nil), data[cut:]...)
+
+	_, err := m.out.Write([]byte(m.replacer.Replace(string(data[:cut]))))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Write held back data. Called when no more data is expected
+func (m *secretMasker) Flush() error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+
+	_, err := m.out.Write([]byte(m.replacer.Replace(string(m.pending))))
+	m.pending = nil
+	return err
+}
+
+// Move the cut back to the start of any secret crossing it, so that secrets are masked as a whole
+func (m *secretMasker) safeCut(data []byte, cut int) int {
+	for moved := true; moved; {
+		moved = false
+		for _, s := range m.secrets {
+			from := cut - len(s) + 1
+			if from < 0 {
+				from = 0
+			}
+
+			idx := bytes.Index(data[from:], s)
+			if idx >= 0 && from+idx < cut {
+				cut = from + idx
+				moved = true
+			}
+		}
+	}
+
+	return cut
+}
+
+// Length of the longest suffix of data which is a beginning of some secret
+func (m *secretMasker) partialSecretSuffix(data []byte) int {
+	longest := 0
+
+	for _, s := range m.secrets {
+		maxLen := len(s) - 1
+		if maxLen > len(data) {
+			maxLen = len(data)
+		}
+
+		for k := maxLen; k > longest; k-- {
+			if bytes.HasSuffix(data, s[:k]) {
+				longest = k
+				break
+			}
+		}
+	}
+
+	return longest
+}
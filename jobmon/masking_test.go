@@ -0,0 +1,83 @@
+package jobmon
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretMasker(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+		chunks  []string
+		want    string
+	}{
+		{
+			name:    "no secrets",
+			secrets: nil,
+			chunks:  []string{"hello ", "world\n"},
+			want:    "hello world\n",
+		},
+		{
+			name:    "secret in one chunk",
+			secrets: []string{"s3cr3t-token"},
+			chunks:  []string{"curl -H \"JOB-TOKEN: s3cr3t-token\" url\n"},
+			want:    "curl -H \"JOB-TOKEN: [MASKED]\" url\n",
+		},
+		{
+			name:    "secret split across chunks",
+			secrets: []string{"s3cr3t-token"},
+			chunks:  []string{"token s3c", "r3t-to", "ken end\n"},
+			want:    "token [MASKED] end\n",
+		},
+		{
+			name:    "partial secret at the end is flushed",
+			secrets: []string{"s3cr3t-token"},
+			chunks:  []string{"almost s3cr3t"},
+			want:    "almost s3cr3t",
+		},
+		{
+			name:    "longer secret wins",
+			secrets: []string{"abcdefgh", "abcdefgh-ijklmnop"},
+			chunks:  []string{"x abcdefgh-ijklmnop y abcdefgh\n"},
+			want:    "x [MASKED] y [MASKED]\n",
+		},
+		{
+			name:    "longer secret wins across writes",
+			secrets: []string{"abcdefgh", "abcdefgh-ijklmnop"},
+			chunks:  []string{"x abcdefgh", "-ijklmnop y abcdefgh", "\n"},
+			want:    "x [MASKED] y [MASKED]\n",
+		},
+		{
+			name:    "overlapping secrets across writes",
+			secrets: []string{"abcd", "cdXY"},
+			chunks:  []string{"1 abcd", " 2"},
+			want:    "1 [MASKED] 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			m := newSecretMasker(&out, tt.secrets)
+
+			for _, c := range tt.chunks {
+				n, err := m.Write([]byte(c))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(c) {
+					t.Errorf("short write: got %d, want %d", n, len(c))
+				}
+			}
+
+			if err := m.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
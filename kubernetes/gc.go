@@ -0,0 +1,124 @@
+package kubernetes
+
+import (
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sisyphus/metrics"
+	"strings"
+	"time"
+)
+
+// How often the namespace is checked for orphans
+const OrphanCollectorInterval = 5 * time.Minute
+
+// Periodically delete objects left behind by crashed runners and failed cleanups.
+// Objects labeled by other runners are left alone. Runs until stopChan is closed
+func (s *Session) RunOrphanCollector(watcher *JobWatcher, runnerName string, ttl time.Duration, stopChan <-chan bool) {
+	logrus.Infof("Deleting orphans older than %s in namespace %s", ttl, s.Namespace)
+
+	ticker := time.NewTicker(OrphanCollectorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := s.collectOrphans(SanitizeLabelValue(runnerName), ttl, watcher.IsMonitored)
+			if err != nil {
+				metrics.K8SErrors.WithLabelValues(metrics.OpListOrphans).Inc()
+				logrus.Warnf("Orphan collector: %v", err)
+			}
+
+			if len(removed) > 0 {
+				logrus.Infof("Orphan collector removed %d objects", len(removed))
+			}
+
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Delete sisyphus objects older than ttl. Jobs are orphans when no monitor watches them,
+// other objects when they have no owner. Owned objects are deleted by K8S together with their job.
+// Returns descriptions of removed objects
+func (s *Session) collectOrphans(runnerLabel string, ttl time.Duration, isMonitored func(job metav1.Object) bool) ([]string, error) {
+	prop := metav1.DeletePropagationBackground
+	opts := &metav1.DeleteOptions{PropagationPolicy: &prop}
+	listOpts := metav1.ListOptions{}
+
+	var removed []string
+	remove := func(kind string, obj metav1.Object, deleteFn func(string, *metav1.DeleteOptions) error) {
+		err := deleteFn(obj.GetName(), opts)
+		if err != nil {
+			metrics.K8SErrors.WithLabelValues(metrics.OpDeleteOrphan).Inc()
+			logrus.Warnf("Orphan collector: failed to delete %s '%s': %v", kind, obj.GetName(), err)
+			return
+		}
+
+		age := time.Since(obj.GetCreationTimestamp().Time).Round(time.Second)
+		logrus.Infof("Orphan collector: deleted %s '%s', age %s", kind, obj.GetName(), age)
+		removed = append(removed, kind+"/"+obj.GetName())
+	}
+
+	// Jobs go first, so no pod is using the volumes
+	jobs, err := s.k8sClient.BatchV1().Jobs(s.Namespace).List(listOpts)
+	if err != nil {
+		return removed, err
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if isOrphanCandidate(job, runnerLabel, ttl) && !isMonitored(job) {
+			remove("job", job, s.k8sClient.BatchV1().Jobs(s.Namespace).Delete)
+		}
+	}
+
+	pvcs, err := s.k8sClient.CoreV1().PersistentVolumeClaims(s.Namespace).List(listOpts)
+	if err != nil {
+		return removed, err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if isOrphanCandidate(pvc, runnerLabel, ttl) && len(pvc.OwnerReferences) == 0 {
+			remove("pvc", pvc, s.k8sClient.CoreV1().PersistentVolumeClaims(s.Namespace).Delete)
+		}
+	}
+
+	configMaps, err := s.k8sClient.CoreV1().ConfigMaps(s.Namespace).List(listOpts)
+	if err != nil {
+		return removed, err
+	}
+	for i := range configMaps.Items {
+		cm := &configMaps.Items[i]
+		if isOrphanCandidate(cm, runnerLabel, ttl) && len(cm.OwnerReferences) == 0 {
+			remove("configmap", cm, s.k8sClient.CoreV1().ConfigMaps(s.Namespace).Delete)
+		}
+	}
+
+	secrets, err := s.k8sClient.CoreV1().Secrets(s.Namespace).List(listOpts)
+	if err != nil {
+		return removed, err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if isOrphanCandidate(secret, runnerLabel, ttl) && len(secret.OwnerReferences) == 0 {
+			remove("secret", secret, s.k8sClient.CoreV1().Secrets(s.Namespace).Delete)
+		}
+	}
+
+	return removed, nil
+}
+
+// Object was created by this runner and is older than ttl.
+// Objects created by older versions have no labels, only the name prefix
+func isOrphanCandidate(obj metav1.Object, runnerLabel string, ttl time.Duration) bool {
+	_, labeled := obj.GetLabels()[LabelGitLabJobId]
+	if !labeled && !strings.HasPrefix(obj.GetName(), NamePrefix) {
+		return false
+	}
+
+	if runner, ok := obj.GetLabels()[LabelRunner]; ok && runner != runnerLabel {
+		return false
+	}
+
+	return time.Since(obj.GetCreationTimestamp().Time) > ttl
+}
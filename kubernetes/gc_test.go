@@ -0,0 +1,73 @@
+package kubernetes
+
+import (
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testObjectMeta(name string, age time.Duration, owned bool) v12.ObjectMeta {
+	meta := v12.ObjectMeta{
+		Name:              name,
+		Namespace:         testNamespace,
+		UID:               types.UID("uid-" + name),
+		CreationTimestamp: v12.NewTime(time.Now().Add(-age)),
+	}
+
+	if owned {
+		meta.OwnerReferences = []v12.OwnerReference{{Kind: "Job", Name: "owner", UID: "uid-owner"}}
+	}
+
+	return meta
+}
+
+func TestSession_collectOrphans(t *testing.T) {
+	ttl := time.Hour
+
+	otherRunnerMeta := testObjectMeta("sphs-1-4-other-runner", 2*ttl, false)
+	otherRunnerMeta.Labels = map[string]string{LabelRunner: "other-runner"}
+
+	monitoredJob := &batchv1.Job{ObjectMeta: testObjectMeta("sphs-1-1-monitored", 2*ttl, false)}
+	objects := []runtime.Object{
+		monitoredJob,
+		&batchv1.Job{ObjectMeta: testObjectMeta("sphs-1-2-abandoned", 2*ttl, false)},
+		&batchv1.Job{ObjectMeta: testObjectMeta("sphs-1-3-fresh", ttl/2, false)},
+		&batchv1.Job{ObjectMeta: testObjectMeta("other-job", 2*ttl, false)},
+		&batchv1.Job{ObjectMeta: otherRunnerMeta},
+		&v1.ConfigMap{ObjectMeta: testObjectMeta("sphs-1-2-entrypoint", 2*ttl, false)},
+		&v1.ConfigMap{ObjectMeta: testObjectMeta("sphs-1-1-owned", 2*ttl, true)},
+		&v1.PersistentVolumeClaim{ObjectMeta: testObjectMeta("sphs-1-2-pvc", 2*ttl, false)},
+		&v1.PersistentVolumeClaim{ObjectMeta: testObjectMeta("sphs-1-3-pvc", ttl/2, false)},
+		&v1.Secret{ObjectMeta: testObjectMeta("sphs-1-2-token", 2*ttl, false)},
+		&v1.Secret{ObjectMeta: testObjectMeta("default-token", 2*ttl, false)},
+	}
+
+	session := NewSession(fake.NewSimpleClientset(objects...), testNamespace)
+	isMonitored := func(job v12.Object) bool {
+		return job.GetUID() == monitoredJob.UID
+	}
+
+	removed, err := session.collectOrphans("runner", ttl, isMonitored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(removed)
+	want := []string{
+		"configmap/sphs-1-2-entrypoint",
+		"job/sphs-1-2-abandoned",
+		"pvc/sphs-1-2-pvc",
+		"secret/sphs-1-2-token",
+	}
+
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+}
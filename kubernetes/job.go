@@ -1,7 +1,6 @@
 package kubernetes
 
 import (
-	"bytes"
 	"io"
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
@@ -12,6 +11,9 @@ import (
 
 const ContainerNameBuilder = "builder"
 
+// Prefix of service container names, followed by the index of the service
+const ContainerNamePrefixService = "svc-"
+
 type Job struct {
 	session *Session
 
@@ -24,29 +26,16 @@ type Job struct {
 	// PVC for /build dir
 	k8sPvc *v1.PersistentVolumeClaim
 
+	// Secret with gitlab job token, needed to resume the job after runner restart
+	k8sTokenSecret *v1.Secret
+
 	// for faster access these values are copied from session
-	k8sClient *kubernetes.Clientset
+	k8sClient kubernetes.Interface
 	namespace string
 	Name      string
 }
 
-// Additional parameters for K8S job spec
-type K8SJobParameters struct {
-	NodeSelector      map[string]string `json:"node_selector"`
-	ResourceRequest   v1.ResourceList   `json:"resource_request"`
-	ActiveDeadlineSec int64             `json:"active_deadline_sec"`
-}
-
-// Get job status
-func (j *Job) GetStatus() (*batchv1.JobStatus, error) {
-	sj, err := j.k8sClient.BatchV1().Jobs(j.namespace).Get(j.Name, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-
-	return &sj.Status, nil
-}
-
+// Status of the job and its pods, read from the caches of JobWatcher
 type K8SJobStatus struct {
 	Job *batchv1.Job
 
@@ -55,12 +44,7 @@ type K8SJobStatus struct {
 	PodPhases map[string]v1.PodPhase
 }
 
-func (j *Job) GetK8SJobStatus() (*K8SJobStatus, error) {
-	sj, err := j.k8sClient.BatchV1().Jobs(j.namespace).Get(j.Name, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-
+func newK8SJobStatus(sj *batchv1.Job, pods []v1.Pod) *K8SJobStatus {
 	// Initialize values to Unknown
 	specContainers := sj.Spec.Template.Spec.Containers
 	phases := make(map[string]v1.PodPhase)
@@ -68,12 +52,6 @@ func (j *Job) GetK8SJobStatus() (*K8SJobStatus, error) {
 		phases[c.Name] = v1.PodUnknown
 	}
 
-	// Get current states of container
-	pods, err := getPodsOfController(j.k8sClient, j.namespace, j.k8sJob.UID)
-	if err != nil {
-		return nil, err
-	}
-
 	for _, p := range pods {
 		for _, c := range p.Spec.Containers {
 			phases[c.Name] = p.Status.Phase
@@ -84,36 +62,60 @@ func (j *Job) GetK8SJobStatus() (*K8SJobStatus, error) {
 		Job:       sj,
 		Pods:      pods,
 		PodPhases: phases,
-	}, nil
+	}
 }
 
-// Get logs of pod
-func (j *Job) GetPodLog(podName string, sinceTime *time.Time) (*bytes.Buffer, error) {
+// Get termination state of the builder container. Returns nil if the builder has not terminated yet
+func (s *K8SJobStatus) BuilderTerminated() *v1.ContainerStateTerminated {
+	for _, p := range s.Pods {
+		for _, cs := range p.Status.ContainerStatuses {
+			if cs.Name == ContainerNameBuilder && cs.State.Terminated != nil {
+				return cs.State.Terminated
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get the latest termination state of the builder container, including the one before restart.
+// Returns nil if the builder has never terminated
+func (s *K8SJobStatus) LastBuilderTermination() *v1.ContainerStateTerminated {
+	if term := s.BuilderTerminated(); term != nil {
+		return term
+	}
+
+	for _, p := range s.Pods {
+		for _, cs := range p.Status.ContainerStatuses {
+			if cs.Name == ContainerNameBuilder && cs.LastTerminationState.Terminated != nil {
+				return cs.LastTerminationState.Terminated
+			}
+		}
+	}
+
+	return nil
+}
+
+// Job runs service containers next to the builder.
+// The service containers never exit, so such a job is never completed by K8S
+func (j *Job) HasSidecars() bool {
+	return len(j.k8sJob.Spec.Template.Spec.Containers) > 1
+}
+
+// Follow log of the builder container. The stream ends when the container terminates.
+// The API has second precision, lines of the second of sinceTime are sent again
+func (j *Job) StreamPodLog(podName string, sinceTime *time.Time) (io.ReadCloser, error) {
 	logOpts := v1.PodLogOptions{
 		Container:  ContainerNameBuilder,
 		Timestamps: true,
+		Follow:     true,
 	}
 
 	if sinceTime != nil {
 		logOpts.SinceTime = &metav1.Time{Time: *sinceTime}
 	}
-	resp := j.k8sClient.CoreV1().Pods(j.namespace).GetLogs(podName, &logOpts)
-	//noinspection GoShadowedVar
-	respStream, err := resp.Stream()
-	if err != nil {
-		return nil, err
-	}
-	//noinspection GoUnhandledErrorResult,GoDeferInLoop
-	defer respStream.Close()
-
-	// Copy to buffer
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, respStream)
-	if err != nil {
-		return nil, err
-	}
 
-	return &buf, nil
+	return j.k8sClient.CoreV1().Pods(j.namespace).GetLogs(podName, &logOpts).Stream()
 }
 
 // Delete job
@@ -0,0 +1,224 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"k8s.io/api/core/v1"
+	errors2 "k8s.io/apimachinery/pkg/api/errors"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Pod of the job controller with a builder container in the given state
+func newBuilderPod(job *Job, name string, phase v1.PodPhase, state v1.ContainerState, last v1.ContainerState) *v1.Pod {
+	isController := true
+	return &v1.Pod{
+		ObjectMeta: v12.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    job.k8sJob.Spec.Template.Labels,
+			OwnerReferences: []v12.OwnerReference{
+				{Kind: "Job", Name: job.Name, UID: job.k8sJob.UID, Controller: &isController},
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: ContainerNameBuilder}},
+		},
+		Status: v1.PodStatus{
+			Phase: phase,
+			ContainerStatuses: []v1.ContainerStatus{
+				{
+					Name:                 ContainerNameBuilder,
+					State:                state,
+					LastTerminationState: last,
+				},
+			},
+		},
+	}
+}
+
+// Wait until the status of the job read from the watcher satisfies the condition
+func waitForStatus(t *testing.T, watcher *JobWatcher, job *Job, changed <-chan struct{}, cond func(*K8SJobStatus, error) bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		if cond(watcher.GetK8SJobStatus(job)) {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			status, err := watcher.GetK8SJobStatus(job)
+			t.Fatalf("unexpected status %+v %v", status, err)
+		}
+	}
+}
+
+func TestJob_lifecycle(t *testing.T) {
+	session, client := newFakeSession()
+
+	job, err := session.CreateGitLabJob("sphs-7-42-", newTestJobSpec(), newTestJobParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All objects are owned by the job, so K8S deletes them together
+	cm, err := client.CoreV1().ConfigMaps(testNamespace).Get(job.k8sEntrypointMap.Name, v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := client.CoreV1().Secrets(testNamespace).Get(job.k8sTokenSecret.Name, v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvc, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(job.k8sPvc.Name, v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, obj := range []v12.Object{cm, secret, pvc} {
+		refs := obj.GetOwnerReferences()
+		if len(refs) != 1 || refs[0].UID != job.k8sJob.UID || refs[0].Kind != "Job" || refs[0].Name != job.Name {
+			t.Errorf("%s is not owned by the job: %v", obj.GetName(), refs)
+		}
+	}
+
+	if job.HasSidecars() {
+		t.Error("job without services has sidecars")
+	}
+
+	// Job monitors read the status from the watcher
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	watcher, err := session.NewJobWatcher(stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, unsubscribe := watcher.Subscribe(job)
+	defer unsubscribe()
+
+	if !watcher.IsMonitored(job.k8sJob) {
+		t.Error("subscribed job is not monitored")
+	}
+
+	// Status of the job without pods
+	waitForStatus(t, watcher, job, changed, func(status *K8SJobStatus, err error) bool {
+		return err == nil && len(status.Pods) == 0 && status.PodPhases[ContainerNameBuilder] == v1.PodUnknown
+	})
+
+	// The builder was restarted after a failure, pods of other controllers are ignored
+	failed := v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 2}}
+	running := v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	other := newBuilderPod(job, "other", v1.PodFailed, failed, v1.ContainerState{})
+	other.OwnerReferences[0].UID = "other-uid"
+
+	for _, pod := range []*v1.Pod{other, newBuilderPod(job, "builder", v1.PodRunning, running, failed)} {
+		_, err = client.CoreV1().Pods(testNamespace).Create(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var status *K8SJobStatus
+	waitForStatus(t, watcher, job, changed, func(s *K8SJobStatus, err error) bool {
+		status = s
+		return err == nil && len(s.Pods) > 0
+	})
+	if len(status.Pods) != 1 || status.Pods[0].Name != "builder" || status.PodPhases[ContainerNameBuilder] != v1.PodRunning {
+		t.Errorf("unexpected status of running job %+v", status)
+	}
+	if status.BuilderTerminated() != nil {
+		t.Error("running builder is terminated")
+	}
+	if term := status.LastBuilderTermination(); term == nil || term.ExitCode != 2 {
+		t.Errorf("unexpected last termination of the builder %v", term)
+	}
+
+	// The builder terminates
+	terminated := newBuilderPod(job, "builder", v1.PodSucceeded, v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 0}}, failed)
+	_, err = client.CoreV1().Pods(testNamespace).Update(terminated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, watcher, job, changed, func(s *K8SJobStatus, err error) bool {
+		return err == nil && s.BuilderTerminated() != nil && s.BuilderTerminated().ExitCode == 0
+	})
+
+	// Delete leaves the owned objects to the garbage collector of K8S
+	client.ClearActions()
+	err = job.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := client.Actions()
+	if len(actions) != 1 || !actions[0].Matches("delete", "jobs") {
+		t.Fatalf("unexpected actions %v", actions)
+	}
+	if actions[0].(k8stesting.DeleteAction).GetName() != job.Name {
+		t.Errorf("wrong job deleted: %v", actions[0])
+	}
+
+	waitForStatus(t, watcher, job, changed, func(_ *K8SJobStatus, err error) bool {
+		return errors2.IsNotFound(err)
+	})
+}
+
+// The fake clientset can not stream logs, the client talks to a stand-in of the API server
+func TestJob_StreamPodLog(t *testing.T) {
+	since := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+	logLines := "2019-11-20T10:00:00.1Z first\n2019-11-20T10:00:01.1Z second\n"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/"+testNamespace+"/pods/builder-pod/log" {
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		if q.Get("container") != ContainerNameBuilder || q.Get("follow") != "true" || q.Get("timestamps") != "true" {
+			t.Errorf("unexpected log options %v", q)
+		}
+		if q.Get("sinceTime") != since.Format(time.RFC3339) {
+			t.Errorf("unexpected sinceTime %s", q.Get("sinceTime"))
+		}
+
+		_, _ = w.Write([]byte(logLines))
+	}))
+	defer server.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{k8sClient: client, namespace: testNamespace}
+
+	stream, err := job.StreamPodLog("builder-pod", &since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer stream.Close()
+
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != logLines {
+		t.Errorf("unexpected log %q", data)
+	}
+
+	_, err = job.StreamPodLog("missing-pod", nil)
+	if !errors2.IsNotFound(err) {
+		t.Errorf("expected not found error for missing pod, got %v", err)
+	}
+}
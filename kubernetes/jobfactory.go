@@ -2,6 +2,7 @@ package kubernetes
 
 import (
 	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	v13 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
@@ -9,18 +10,27 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	"sisyphus/cache"
+	"sisyphus/executor"
 	"sisyphus/protocol"
 	"sisyphus/shell"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 const sisyphusStorageClass = "topology-aware-fast"
 
+// Time given to the job script to run `always` steps like after_script when the pod is terminated
+const terminationGracePeriodSec int64 = 300
+
 var ensureOnce sync.Once
 
 // Create new job and start it
-func newJobFromGitLab(session *Session, namePrefix string, spec *protocol.JobSpec, k8sJobParams *K8SJobParameters, cacheBucket string) (*Job, error) {
+func newJobFromGitLab(session *Session, namePrefix string, spec *protocol.JobSpec, k8sJobParams *executor.JobParameters, cacheSettings *cache.Settings) (*Job, error) {
 	ensureOnce.Do(func() {
 		err := ensureStorageClass(session.k8sClient)
 		if err != nil {
@@ -28,51 +38,114 @@ func newJobFromGitLab(session *Session, namePrefix string, spec *protocol.JobSpe
 		}
 	})
 
-	// Create config map volume with entrypoint script
-	script, err := shell.GenerateScript(spec, cacheBucket)
+	qCpu, script, err := prepareJob(spec, k8sJobParams, cacheSettings)
 	if err != nil {
 		return nil, err
 	}
 
-	entrypointTemplate := newEntryPointScript(namePrefix, script)
+	objectMeta := newObjectMeta(namePrefix, spec, k8sJobParams)
+
+	secretTemplate, err := newTokenSecret(objectMeta, spec, script.SecretEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is left behind if any of the steps fails
+	created := newCreatedObjects(session.k8sClient, session.Namespace)
+
+	// Create secret with job token
+	tokenSecret, err := session.k8sClient.CoreV1().Secrets(session.Namespace).Create(secretTemplate)
+	if err != nil {
+		return nil, err
+	}
+	created.secrets = append(created.secrets, tokenSecret.Name)
+
+	entrypointTemplate := newEntryPointScript(objectMeta, script.Text)
 	entrypoint, err := session.k8sClient.CoreV1().ConfigMaps(session.Namespace).Create(entrypointTemplate)
 	if err != nil {
+		created.rollback()
 		return nil, err
 	}
+	created.configMaps = append(created.configMaps, entrypoint.Name)
 
 	// Create new PVC
-	pvcTemplate := newPvc(namePrefix, k8sJobParams.ResourceRequest[v1.ResourceStorage])
+	pvcTemplate := newPvc(objectMeta, k8sJobParams.ResourceRequest[v1.ResourceStorage])
 	pvc, err := session.k8sClient.CoreV1().PersistentVolumeClaims(session.Namespace).Create(pvcTemplate)
 	if err != nil {
+		created.rollback()
 		return nil, err
 	}
+	created.pvcs = append(created.pvcs, pvc.Name)
 
 	// Create new Job
-	qCpu, ok := k8sJobParams.ResourceRequest[v1.ResourceCPU]
-	if !ok {
-		return nil, errors.New("unknown quantity of cpu request")
-	}
-	jobTemplate := jobFromGitHubSpec(namePrefix, spec, k8sJobParams.ActiveDeadlineSec, k8sJobParams.NodeSelector, qCpu, entrypoint.Name, pvc.Name)
+	jobTemplate := jobFromGitHubSpec(objectMeta, spec, k8sJobParams.ActiveDeadlineSec, k8sJobParams.NodeSelector, qCpu, entrypoint.Name, pvc.Name, tokenSecret.Name)
+	addCacheVolume(jobTemplate, k8sJobParams)
+	addSecretEnv(jobTemplate, tokenSecret.Name, script.SecretEnv)
 	k8sJob, err := session.k8sClient.BatchV1().Jobs(session.Namespace).Create(jobTemplate)
 	if err != nil {
+		created.rollback()
 		return nil, err
 	}
+	created.jobs = append(created.jobs, k8sJob.Name)
 
 	theJob := Job{
 		session:          session,
 		k8sJob:           k8sJob,
 		k8sEntrypointMap: entrypoint,
 		k8sPvc:           pvc,
+		k8sTokenSecret:   tokenSecret,
 		k8sClient:        session.k8sClient,
 		namespace:        session.Namespace,
 		Name:             k8sJob.Name,
 	}
 
-	return assignOwners(theJob)
+	ownedJob, err := assignOwners(theJob)
+	if err != nil {
+		created.rollback()
+		return nil, err
+	}
+
+	return ownedJob, nil
+}
+
+// Validate job parameters and generate the entrypoint script
+func prepareJob(spec *protocol.JobSpec, k8sJobParams *executor.JobParameters, cacheSettings *cache.Settings) (resource.Quantity, *shell.Script, error) {
+	qCpu, ok := k8sJobParams.ResourceRequest[v1.ResourceCPU]
+	if !ok {
+		return qCpu, nil, errors.New("unknown quantity of cpu request")
+	}
+
+	script, err := shell.GenerateScript(spec, cacheSettings)
+	if err != nil {
+		return qCpu, nil, err
+	}
+
+	return qCpu, script, nil
+}
+
+// Metadata shared by all objects of the job. The job and project id labels are required for watching and resuming
+func newObjectMeta(namePrefix string, spec *protocol.JobSpec, k8sJobParams *executor.JobParameters) v12.ObjectMeta {
+	labels := make(map[string]string, len(k8sJobParams.Labels)+2)
+	for k, v := range k8sJobParams.Labels {
+		labels[k] = v
+	}
+	labels[LabelGitLabJobId] = strconv.Itoa(spec.Id)
+	labels[LabelGitLabProjectId] = strconv.Itoa(spec.JobInfo.ProjectId)
+
+	annotations := make(map[string]string, len(k8sJobParams.Annotations))
+	for k, v := range k8sJobParams.Annotations {
+		annotations[k] = v
+	}
+
+	return v12.ObjectMeta{
+		GenerateName: namePrefix,
+		Labels:       labels,
+		Annotations:  annotations,
+	}
 }
 
 // Ensure that custom storage class for PVC is created
-func ensureStorageClass(k8sClient *kubernetes.Clientset) error {
+func ensureStorageClass(k8sClient kubernetes.Interface) error {
 	_, err := k8sClient.StorageV1().StorageClasses().Get(sisyphusStorageClass, v12.GetOptions{})
 	if err == nil {
 		return nil
@@ -112,7 +185,12 @@ func assignOwners(newJob Job) (*Job, error) {
 		return nil, err
 	}
 
-	modJob, err = patchPvc(newJob, ownerRef)
+	modJob, err = patchPvc(*modJob, ownerRef)
+	if err != nil {
+		return nil, err
+	}
+
+	modJob, err = patchTokenSecret(*modJob, ownerRef)
 	if err != nil {
 		return nil, err
 	}
@@ -162,12 +240,31 @@ func patchPvc(newJob Job, ownerRef v12.OwnerReference) (*Job, error) {
 	return &newJob, nil
 }
 
+func patchTokenSecret(newJob Job, ownerRef v12.OwnerReference) (*Job, error) {
+	// Modify secret ownership
+	origObj := newJob.k8sTokenSecret
+	modObj := origObj.DeepCopy()
+	modObj.OwnerReferences = append(modObj.OwnerReferences, ownerRef)
+	objectName := origObj.Name
+
+	patchData, err := genPatch(origObj, modObj)
+	if err != nil {
+		return nil, err
+	}
+
+	modSecret, err := newJob.k8sClient.CoreV1().Secrets(newJob.namespace).Patch(objectName, types.StrategicMergePatchType, patchData)
+	if err != nil {
+		return nil, err
+	}
+	newJob.k8sTokenSecret = modSecret
+
+	return &newJob, nil
+}
+
 // Create entry point script
-func newEntryPointScript(nameTemplate string, script string) *v1.ConfigMap {
+func newEntryPointScript(objectMeta v12.ObjectMeta, script string) *v1.ConfigMap {
 	return &v1.ConfigMap{
-		ObjectMeta: v12.ObjectMeta{
-			GenerateName: nameTemplate,
-		},
+		ObjectMeta: *objectMeta.DeepCopy(),
 
 		Data: map[string]string{
 			"entrypoint.sh": script,
@@ -175,12 +272,10 @@ func newEntryPointScript(nameTemplate string, script string) *v1.ConfigMap {
 	}
 }
 
-func newPvc(nameTemplate string, volumeSize resource.Quantity) *v1.PersistentVolumeClaim {
+func newPvc(objectMeta v12.ObjectMeta, volumeSize resource.Quantity) *v1.PersistentVolumeClaim {
 	sClass := sisyphusStorageClass
 	return &v1.PersistentVolumeClaim{
-		ObjectMeta: v12.ObjectMeta{
-			GenerateName: nameTemplate,
-		},
+		ObjectMeta: *objectMeta.DeepCopy(),
 
 		Spec: v1.PersistentVolumeClaimSpec{
 			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
@@ -195,29 +290,41 @@ func newPvc(nameTemplate string, volumeSize resource.Quantity) *v1.PersistentVol
 }
 
 // Create K8S job from github spec
-func jobFromGitHubSpec(namePrefix string,
+func jobFromGitHubSpec(objectMeta v12.ObjectMeta,
 	spec *protocol.JobSpec,
 	activeDeadlineSec int64,
 	nodeSelector map[string]string,
 	cpuRequest resource.Quantity,
 	entryPointName string,
-	pvcName string) *v13.Job {
+	pvcName string,
+	tokenSecretName string) *v13.Job {
 
 	backOffLimit := int32(1)
 	accessMode := int32(ConfigMapAccessMode)
+	gracePeriod := terminationGracePeriodSec
+
+	jobMeta := objectMeta.DeepCopy()
+	jobMeta.Annotations[AnnotationTokenSecret] = tokenSecretName
 
 	theJob := &v13.Job{
-		ObjectMeta: v12.ObjectMeta{
-			GenerateName: namePrefix,
-		},
+		ObjectMeta: *jobMeta,
 
 		Spec: v13.JobSpec{
 			BackoffLimit: &backOffLimit,
 
+			// The deadline covers the whole job. On the pod it would only fail the pod and the job would report the backoff limit
+			ActiveDeadlineSeconds: &activeDeadlineSec,
+
 			Template: v1.PodTemplateSpec{
+				ObjectMeta: v12.ObjectMeta{
+					Labels:      objectMeta.Labels,
+					Annotations: objectMeta.Annotations,
+				},
+
 				Spec: v1.PodSpec{
-					RestartPolicy:         v1.RestartPolicyOnFailure,
-					ActiveDeadlineSeconds: &activeDeadlineSec,
+					RestartPolicy: v1.RestartPolicyOnFailure,
+
+					TerminationGracePeriodSeconds: &gracePeriod,
 
 					Containers: []v1.Container{
 						{
@@ -238,7 +345,7 @@ func jobFromGitHubSpec(namePrefix string,
 								},
 								{
 									Name:      "buildpvc",
-									MountPath: "/build",
+									MountPath: shell.DefaultBuildDir,
 								},
 							},
 
@@ -279,9 +386,139 @@ func jobFromGitHubSpec(namePrefix string,
 		},
 	}
 
+	// Services are started before the builder and share the pod network with it.
+	// The pod keeps running with the services, so a failed builder must not be restarted in place:
+	// it would run the whole script again and its first exit code would be lost
+	if len(spec.Services) > 0 {
+		podSpec := &theJob.Spec.Template.Spec
+		podSpec.Containers = append(newServiceContainers(spec.Services, spec.Variables), podSpec.Containers...)
+		podSpec.HostAliases = newServiceHostAliases(spec.Services)
+		podSpec.RestartPolicy = v1.RestartPolicyNever
+
+		noRetries := int32(0)
+		theJob.Spec.BackoffLimit = &noRetries
+	}
+
 	return theJob
 }
 
+// Mount the cache volume into the builder container
+func addCacheVolume(job *v13.Job, k8sJobParams *executor.JobParameters) {
+	if len(k8sJobParams.CacheVolumeClaim) == 0 {
+		return
+	}
+
+	podSpec := &job.Spec.Template.Spec
+	podSpec.Volumes = append(podSpec.Volumes, v1.Volume{
+		Name: "cache",
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: k8sJobParams.CacheVolumeClaim,
+			},
+		},
+	})
+
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		if c.Name == ContainerNameBuilder {
+			c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{
+				Name:      "cache",
+				MountPath: k8sJobParams.CacheVolumePath,
+			})
+		}
+	}
+}
+
+// Pass the secret environment of the script to the builder container from the token secret,
+// so signed URLs are not stored in the entrypoint config map
+func addSecretEnv(job *v13.Job, tokenSecretName string, secretEnv map[string]string) {
+	names := make([]string, 0, len(secretEnv))
+	for name := range secretEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	podSpec := &job.Spec.Template.Spec
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		if c.Name != ContainerNameBuilder {
+			continue
+		}
+
+		for _, name := range names {
+			c.Env = append(c.Env, v1.EnvVar{
+				Name: name,
+				ValueFrom: &v1.EnvVarSource{
+					SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: tokenSecretName},
+						Key:                  name,
+					},
+				},
+			})
+		}
+	}
+}
+
+// Create sidecar containers for gitlab services
+func newServiceContainers(services []protocol.JobService, jobVars []protocol.JobVariable) []v1.Container {
+	result := make([]v1.Container, len(services))
+
+	for i, svc := range services {
+		// Services see the job variables, service variables override them
+		vars := make([]protocol.JobVariable, 0, len(jobVars)+len(svc.Variables))
+		vars = append(vars, jobVars...)
+		vars = append(vars, svc.Variables...)
+
+		result[i] = v1.Container{
+			Name:            fmt.Sprintf("%s%d", ContainerNamePrefixService, i),
+			Image:           svc.Name,
+			ImagePullPolicy: v1.PullIfNotPresent,
+			Command:         svc.Entrypoint,
+			Args:            svc.Command,
+			Env:             convertEnvVars(vars),
+		}
+	}
+
+	return result
+}
+
+// All containers share the loopback interface, so every service hostname resolves to it
+func newServiceHostAliases(services []protocol.JobService) []v1.HostAlias {
+	hostnames := make([]string, 0, len(services))
+	seen := make(map[string]bool)
+
+	for _, svc := range services {
+		for _, h := range serviceHostnames(&svc) {
+			if errs := validation.IsDNS1123Subdomain(h); len(errs) > 0 {
+				logrus.Warnf("Skipping service hostname '%s': %s", h, strings.Join(errs, ", "))
+				continue
+			}
+
+			if !seen[h] {
+				seen[h] = true
+				hostnames = append(hostnames, h)
+			}
+		}
+	}
+
+	return []v1.HostAlias{
+		{
+			IP:        "127.0.0.1",
+			Hostnames: hostnames,
+		},
+	}
+}
+
+// Hostnames of the service in the same way as gitlab runner names them.
+// For example registry.example.com/tutum/wordpress:latest -> tutum-wordpress
+func serviceHostnames(svc *protocol.JobService) []string {
+	repository := protocol.ParseImageName(svc.Name).Repository
+	result := []string{strings.Replace(repository, "/", "-", -1)}
+	result = append(result, strings.Fields(svc.Alias)...)
+
+	return result
+}
+
 func convertEnvVars(vars []protocol.JobVariable) []v1.EnvVar {
 	result := make([]v1.EnvVar, len(vars))
 
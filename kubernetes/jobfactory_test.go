@@ -0,0 +1,348 @@
+package kubernetes
+
+import (
+	"errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"sisyphus/cache"
+	"sisyphus/conf"
+	"sisyphus/executor"
+	"sisyphus/protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNamespace = "sisyphus-test"
+
+// Session backed by fake clientset. The fake object tracker does not generate names and UIDs, the reactor does
+func newFakeSession() (*Session, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := meta.Accessor(action.(k8stesting.CreateAction).GetObject())
+		if err != nil {
+			return false, nil, err
+		}
+
+		if len(obj.GetName()) == 0 && len(obj.GetGenerateName()) > 0 {
+			obj.SetName(obj.GetGenerateName() + utilrand.String(5))
+		}
+		obj.SetUID(types.UID(utilrand.String(16)))
+
+		return false, nil, nil
+	})
+
+	return NewSession(client, testNamespace), client
+}
+
+func failOn(verb string, resource string) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New(verb + " " + resource + " failed")
+	}
+}
+
+func newTestJobSpec() *protocol.JobSpec {
+	return &protocol.JobSpec{
+		Id:    42,
+		Token: "token",
+		Image: protocol.JobImage{Name: "alpine:3"},
+		JobInfo: protocol.JobInfo{
+			Name:        "test",
+			ProjectId:   7,
+			ProjectName: "sisyphus",
+		},
+	}
+}
+
+func newTestJobParams() *executor.JobParameters {
+	return &executor.JobParameters{
+		ResourceRequest: v1.ResourceList{
+			v1.ResourceCPU:     resource.MustParse("1"),
+			v1.ResourceStorage: resource.MustParse("1Gi"),
+		},
+		ActiveDeadlineSec: 60,
+	}
+}
+
+// Count objects left in the namespace
+func countObjects(t *testing.T, client *fake.Clientset) (int, int, int, int) {
+	secrets, err := client.CoreV1().Secrets(testNamespace).List(v12.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cms, err := client.CoreV1().ConfigMaps(testNamespace).List(v12.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pvcs, err := client.CoreV1().PersistentVolumeClaims(testNamespace).List(v12.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := client.BatchV1().Jobs(testNamespace).List(v12.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(secrets.Items), len(cms.Items), len(pvcs.Items), len(jobs.Items)
+}
+
+func Test_newJobFromGitLab(t *testing.T) {
+	session, client := newFakeSession()
+	params := newTestJobParams()
+	params.Labels = map[string]string{"team": "ci"}
+
+	job, err := newJobFromGitLab(session, "sphs-7-42-", newTestJobSpec(), params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, cms, pvcs, jobs := countObjects(t, client)
+	if secrets != 1 || cms != 1 || pvcs != 1 || jobs != 1 {
+		t.Errorf("expected one object of each kind, got secrets=%d configmaps=%d pvcs=%d jobs=%d", secrets, cms, pvcs, jobs)
+	}
+
+	pvc, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(job.k8sPvc.Name, v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pvc.OwnerReferences) != 1 || pvc.OwnerReferences[0].UID != job.k8sJob.UID {
+		t.Errorf("pvc is not owned by the job: %v", pvc.OwnerReferences)
+	}
+
+	if pvc.Labels["team"] != "ci" || pvc.Labels[LabelGitLabJobId] != "42" {
+		t.Errorf("pvc is not labeled: %v", pvc.Labels)
+	}
+}
+
+// Signed cache URLs are passed to the builder from the token secret, the config map has only references to them
+func Test_newJobFromGitLab_cacheUrls(t *testing.T) {
+	cacheSettings, err := cache.NewSettings(&conf.SisyphusConf{Cache: conf.CacheConf{
+		Type: conf.CacheS3,
+		S3:   conf.S3CacheConf{Endpoint: "http://minio:9000", Bucket: "cache", AccessKey: "key", SecretKey: "secret"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := newTestJobSpec()
+	spec.Cache = []protocol.JobCache{{Key: "deps", Paths: []string{"vendor"}}}
+
+	session, client := newFakeSession()
+	job, err := newJobFromGitLab(session, "sphs-7-42-", spec, newTestJobParams(), cacheSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := job.k8sEntrypointMap.Data["entrypoint.sh"]
+	if strings.Contains(script, "X-Amz-Signature") || !strings.Contains(script, "${SFS_CACHE_URL_") {
+		t.Errorf("signed URLs are in the entrypoint script:\n%s", script)
+	}
+
+	secret, err := client.CoreV1().Secrets(testNamespace).Get(job.k8sTokenSecret.Name, v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := job.k8sJob.Spec.Template.Spec.Containers[0]
+	var urls int
+	for _, env := range builder.Env {
+		if !strings.HasPrefix(env.Name, "SFS_CACHE_URL_") {
+			continue
+		}
+		urls++
+
+		ref := env.ValueFrom
+		if ref == nil || ref.SecretKeyRef == nil || ref.SecretKeyRef.Name != secret.Name || ref.SecretKeyRef.Key != env.Name {
+			t.Errorf("unexpected env var %+v", env)
+		} else if !strings.Contains(string(secret.Data[env.Name]), "X-Amz-Signature") {
+			t.Errorf("secret has no signed URL for %s", env.Name)
+		}
+	}
+
+	// Archive downloaded and uploaded
+	if urls != 2 {
+		t.Errorf("expected 2 signed URLs, got %d", urls)
+	}
+}
+
+// A failure at any step must not leave objects behind
+func Test_newJobFromGitLab_rollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		verb     string
+		resource string
+	}{
+		{"configmap creation", "create", "configmaps"},
+		{"pvc creation", "create", "persistentvolumeclaims"},
+		{"job creation", "create", "jobs"},
+		{"configmap owner patch", "patch", "configmaps"},
+		{"pvc owner patch", "patch", "persistentvolumeclaims"},
+		{"secret owner patch", "patch", "secrets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, client := newFakeSession()
+			client.PrependReactor(tt.verb, tt.resource, failOn(tt.verb, tt.resource))
+
+			job, err := newJobFromGitLab(session, "sphs-7-42-", newTestJobSpec(), newTestJobParams(), nil)
+			if err == nil {
+				t.Fatalf("expected error, got job %v", job)
+			}
+
+			secrets, cms, pvcs, jobs := countObjects(t, client)
+			if secrets != 0 || cms != 0 || pvcs != 0 || jobs != 0 {
+				t.Errorf("objects leaked: secrets=%d configmaps=%d pvcs=%d jobs=%d", secrets, cms, pvcs, jobs)
+			}
+		})
+	}
+}
+
+func TestSession_ListResumableJobs(t *testing.T) {
+	session, _ := newFakeSession()
+	spec := newTestJobSpec()
+	spec.Variables = []protocol.JobVariable{{Key: "PASSWORD", Value: "secret-password", Masked: true}}
+
+	params := newTestJobParams()
+	params.Labels = map[string]string{LabelRunner: "runner-a"}
+	job, err := newJobFromGitLab(session, "sphs-7-42-", spec, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs of other runners sharing the namespace are not resumed
+	otherSpec := newTestJobSpec()
+	otherSpec.Id = 43
+	otherParams := newTestJobParams()
+	otherParams.Labels = map[string]string{LabelRunner: "runner-b"}
+	_, err = newJobFromGitLab(session, "sphs-7-43-", otherSpec, otherParams, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+	err = job.SaveTraceCheckpoint(executor.TraceCheckpoint{Offset: 1234, LastTimestamp: &ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumable, err := session.ListResumableJobs("Runner A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resumable) != 1 {
+		t.Fatalf("expected 1 resumable job, got %d", len(resumable))
+	}
+
+	rj := resumable[0]
+	if rj.GitLabJobId != spec.Id || rj.ProjectId != spec.JobInfo.ProjectId || rj.Token != spec.Token || rj.Job.Name != job.Name {
+		t.Errorf("unexpected job %+v", rj)
+	}
+
+	if !reflect.DeepEqual(rj.MaskedValues, []string{"token", "secret-password"}) {
+		t.Errorf("unexpected masked values %v", rj.MaskedValues)
+	}
+
+	if rj.Checkpoint.Offset != 1234 || rj.Checkpoint.LastTimestamp == nil || !rj.Checkpoint.LastTimestamp.Equal(ts) {
+		t.Errorf("unexpected checkpoint %+v", rj.Checkpoint)
+	}
+}
+
+func Test_jobFromGitHubSpec_services(t *testing.T) {
+	spec := newTestJobSpec()
+	spec.Variables = []protocol.JobVariable{{Key: "POSTGRES_DB", Value: "job"}, {Key: "CI", Value: "true"}}
+	spec.Services = []protocol.JobService{
+		{
+			Name:      "registry.example.com/library/postgres:11",
+			Alias:     "db pg",
+			Command:   []string{"postgres", "-c", "fsync=off"},
+			Variables: []protocol.JobVariable{{Key: "POSTGRES_DB", Value: "service"}},
+		},
+		{Name: "redis@sha256:abc", Entrypoint: []string{"redis-server"}},
+		{Name: "tutum/wordpress:latest", Alias: "Invalid_Alias"},
+	}
+
+	manifests, err := RenderGitLabJob(spec, newTestJobParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := manifests.Job
+	podSpec := job.Spec.Template.Spec
+
+	// Services go first, the builder is the last container
+	var names []string
+	for _, c := range podSpec.Containers {
+		names = append(names, c.Name)
+	}
+	expectedNames := []string{ContainerNamePrefixService + "0", ContainerNamePrefixService + "1", ContainerNamePrefixService + "2", ContainerNameBuilder}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("unexpected containers %v", names)
+	}
+
+	postgres := podSpec.Containers[0]
+	if postgres.Image != spec.Services[0].Name || !reflect.DeepEqual(postgres.Args, spec.Services[0].Command) {
+		t.Errorf("unexpected postgres container %+v", postgres)
+	}
+
+	// Service variables override the job variables, the last value of a duplicate env var wins in K8S
+	env := postgres.Env
+	if len(env) != 3 || env[len(env)-1].Name != "POSTGRES_DB" || env[len(env)-1].Value != "service" {
+		t.Errorf("unexpected postgres env %v", env)
+	}
+
+	if redis := podSpec.Containers[1]; !reflect.DeepEqual(redis.Command, []string{"redis-server"}) || len(redis.Args) != 0 {
+		t.Errorf("unexpected redis container %+v", redis)
+	}
+
+	expectedAliases := []v1.HostAlias{{
+		IP:        "127.0.0.1",
+		Hostnames: []string{"library-postgres", "db", "pg", "redis", "tutum-wordpress"},
+	}}
+	if !reflect.DeepEqual(podSpec.HostAliases, expectedAliases) {
+		t.Errorf("unexpected host aliases %v", podSpec.HostAliases)
+	}
+
+	// The builder is not restarted next to running services
+	if podSpec.RestartPolicy != v1.RestartPolicyNever || job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 0 {
+		t.Errorf("unexpected restart policy %s, backoff limit %v", podSpec.RestartPolicy, job.Spec.BackoffLimit)
+	}
+
+	// Jobs without services keep the default
+	manifests, err = RenderGitLabJob(newTestJobSpec(), newTestJobParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifests.Job.Spec.Template.Spec.RestartPolicy != v1.RestartPolicyOnFailure || len(manifests.Job.Spec.Template.Spec.HostAliases) != 0 {
+		t.Errorf("unexpected pod spec of job without services %+v", manifests.Job.Spec.Template.Spec)
+	}
+}
+
+// The deadline is enforced by the job controller, so the job fails with DeadlineExceeded
+func Test_jobFromGitHubSpec_deadline(t *testing.T) {
+	manifests, err := RenderGitLabJob(newTestJobSpec(), newTestJobParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := manifests.Job
+	if job.Spec.ActiveDeadlineSeconds == nil || *job.Spec.ActiveDeadlineSeconds != 60 {
+		t.Errorf("unexpected job deadline %v", job.Spec.ActiveDeadlineSeconds)
+	}
+	if job.Spec.Template.Spec.ActiveDeadlineSeconds != nil {
+		t.Errorf("unexpected pod deadline %d", *job.Spec.Template.Spec.ActiveDeadlineSeconds)
+	}
+}
@@ -0,0 +1,226 @@
+package kubernetes
+
+import (
+	"bytes"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"regexp"
+	"sisyphus/protocol"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Names of all objects created by sisyphus start with the prefix
+const NamePrefix = "sphs-"
+
+// Prefix of generated names of the job objects
+func JobNamePrefix(spec *protocol.JobSpec) string {
+	return fmt.Sprintf("%s%v-%v-", NamePrefix, spec.JobInfo.ProjectId, spec.Id)
+}
+
+// Labels and annotations of objects created by sisyphus
+const (
+	// Name of the runner. Set on all objects
+	LabelRunner = "sisyphus/runner"
+
+	// Id of the gitlab job. Set on all objects
+	LabelGitLabJobId = "sisyphus/gitlab-job-id"
+
+	// Id of the gitlab project of the job. Set on all objects
+	LabelGitLabProjectId = "sisyphus/gitlab-project-id"
+
+	// Metadata of the gitlab job. Set on all objects, as sanitized labels and as annotations with original values
+	LabelGitLabProjectPath = "sisyphus/gitlab-project-path"
+	LabelGitLabPipelineId  = "sisyphus/gitlab-pipeline-id"
+	LabelGitLabRef         = "sisyphus/gitlab-ref"
+	LabelGitLabStage       = "sisyphus/gitlab-stage"
+	LabelGitLabJobName     = "sisyphus/gitlab-job-name"
+
+	// Name of the secret with gitlab job token. Set on K8S jobs
+	AnnotationTokenSecret = "sisyphus/token-secret"
+
+	// Progress of the gitlab trace. Set on the token secret
+	AnnotationTraceOffset    = "sisyphus/trace-offset"
+	AnnotationTraceTimestamp = "sisyphus/trace-timestamp"
+)
+
+// Metadata of gitlab job, available to label and annotation templates
+type JobMetadata struct {
+	RunnerName  string
+	ProjectId   int
+	ProjectPath string
+	JobId       int
+	PipelineId  string
+	Ref         string
+	Stage       string
+	JobName     string
+}
+
+func NewJobMetadata(runnerName string, spec *protocol.JobSpec) *JobMetadata {
+	vars := protocol.GetEnvVars(spec)
+
+	return &JobMetadata{
+		RunnerName:  runnerName,
+		ProjectId:   spec.JobInfo.ProjectId,
+		ProjectPath: vars["CI_PROJECT_PATH"],
+		JobId:       spec.Id,
+		PipelineId:  vars["CI_PIPELINE_ID"],
+		Ref:         spec.GitInfo.Ref,
+		Stage:       spec.JobInfo.Stage,
+		JobName:     spec.JobInfo.Name,
+	}
+}
+
+// Extra labels and annotations from configuration. Values are templates of JobMetadata
+type ObjectMetaTemplates struct {
+	labels      map[string]*template.Template
+	annotations map[string]*template.Template
+}
+
+func NewObjectMetaTemplates(labels map[string]string, annotations map[string]string) (*ObjectMetaTemplates, error) {
+	for key := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label '%s': %s", key, strings.Join(errs, ", "))
+		}
+	}
+
+	for key := range annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid annotation '%s': %s", key, strings.Join(errs, ", "))
+		}
+	}
+
+	labelTemplates, err := parseTemplates(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	annotationTemplates, err := parseTemplates(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectMetaTemplates{
+		labels:      labelTemplates,
+		annotations: annotationTemplates,
+	}, nil
+}
+
+func parseTemplates(values map[string]string) (map[string]*template.Template, error) {
+	result := make(map[string]*template.Template, len(values))
+
+	for key, val := range values {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of '%s': %v", key, err)
+		}
+		result[key] = tmpl
+	}
+
+	return result, nil
+}
+
+// Render labels and annotations of the job. Extra labels can not override the sisyphus ones
+func (t *ObjectMetaTemplates) Render(meta *JobMetadata) (map[string]string, map[string]string, error) {
+	labels := make(map[string]string)
+	annotations := make(map[string]string)
+
+	for key, tmpl := range t.labels {
+		val, err := renderTemplate(tmpl, meta)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if val = SanitizeLabelValue(val); len(val) > 0 {
+			labels[key] = val
+		}
+	}
+
+	for key, tmpl := range t.annotations {
+		val, err := renderTemplate(tmpl, meta)
+		if err != nil {
+			return nil, nil, err
+		}
+		annotations[key] = val
+	}
+
+	for key, val := range meta.labels() {
+		labels[key] = val
+	}
+
+	for key, val := range meta.annotations() {
+		annotations[key] = val
+	}
+
+	return labels, annotations, nil
+}
+
+func renderTemplate(tmpl *template.Template, meta *JobMetadata) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, meta)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// Sisyphus labels. Empty values are left out
+func (m *JobMetadata) labels() map[string]string {
+	result := map[string]string{
+		LabelGitLabJobId:     strconv.Itoa(m.JobId),
+		LabelGitLabProjectId: strconv.Itoa(m.ProjectId),
+	}
+
+	sanitized := map[string]string{
+		LabelRunner:            m.RunnerName,
+		LabelGitLabProjectPath: m.ProjectPath,
+		LabelGitLabPipelineId:  m.PipelineId,
+		LabelGitLabRef:         m.Ref,
+		LabelGitLabStage:       m.Stage,
+		LabelGitLabJobName:     m.JobName,
+	}
+
+	for key, val := range sanitized {
+		if val = SanitizeLabelValue(val); len(val) > 0 {
+			result[key] = val
+		}
+	}
+
+	return result
+}
+
+// Original values of the sanitized labels
+func (m *JobMetadata) annotations() map[string]string {
+	result := make(map[string]string)
+
+	original := map[string]string{
+		LabelGitLabProjectPath: m.ProjectPath,
+		LabelGitLabRef:         m.Ref,
+		LabelGitLabStage:       m.Stage,
+		LabelGitLabJobName:     m.JobName,
+	}
+
+	for key, val := range original {
+		if len(val) > 0 {
+			result[key] = val
+		}
+	}
+
+	return result
+}
+
+var invalidLabelChars = regexp.MustCompile("[^a-z0-9]+")
+
+// Make DNS-1123 label from arbitrary text: lowercase alphanumerics and '-', at most 63 characters
+func SanitizeLabelValue(val string) string {
+	val = invalidLabelChars.ReplaceAllString(strings.ToLower(val), "-")
+	val = strings.Trim(val, "-")
+
+	if len(val) > validation.DNS1123LabelMaxLength {
+		val = strings.TrimRight(val[:validation.DNS1123LabelMaxLength], "-")
+	}
+
+	return val
+}
@@ -0,0 +1,96 @@
+package kubernetes
+
+import (
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"main", "main"},
+		{"Feature/ABC-123_fix", "feature-abc-123-fix"},
+		{"group/sub group/project", "group-sub-group-project"},
+		{"--refs/tags/v1.0--", "refs-tags-v1-0"},
+		{"!!!", ""},
+		{strings.Repeat("a", 62) + "/b", strings.Repeat("a", 62)},
+	}
+
+	for _, tt := range tests {
+		got := SanitizeLabelValue(tt.val)
+		if got != tt.want {
+			t.Errorf("SanitizeLabelValue(%q) = %q, want %q", tt.val, got, tt.want)
+		}
+
+		if errs := validation.IsDNS1123Label(got); len(got) > 0 && len(errs) > 0 {
+			t.Errorf("%q is not a DNS-1123 label: %v", got, errs)
+		}
+	}
+}
+
+func TestObjectMetaTemplates_Render(t *testing.T) {
+	templates, err := NewObjectMetaTemplates(
+		map[string]string{
+			"team":                 "{{ .ProjectPath }}",
+			LabelGitLabJobId:       "overridden",
+			"example.com/pipeline": "p-{{ .PipelineId }}",
+		},
+		map[string]string{
+			"example.com/ref": "{{ .Ref }}",
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &JobMetadata{
+		RunnerName:  "Sisyphus Runner",
+		ProjectId:   7,
+		ProjectPath: "Group/Project",
+		JobId:       42,
+		PipelineId:  "1001",
+		Ref:         "feature/x",
+		Stage:       "test",
+		JobName:     "unit tests",
+	}
+
+	labels, annotations, err := templates.Render(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantLabels := map[string]string{
+		"team":                 "group-project",
+		"example.com/pipeline": "p-1001",
+		LabelRunner:            "sisyphus-runner",
+		LabelGitLabJobId:       "42",
+		LabelGitLabProjectId:   "7",
+		LabelGitLabProjectPath: "group-project",
+		LabelGitLabPipelineId:  "1001",
+		LabelGitLabRef:         "feature-x",
+		LabelGitLabStage:       "test",
+		LabelGitLabJobName:     "unit-tests",
+	}
+
+	for k, v := range wantLabels {
+		if labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, labels[k], v)
+		}
+	}
+
+	if annotations["example.com/ref"] != "feature/x" || annotations[LabelGitLabProjectPath] != "Group/Project" {
+		t.Errorf("unexpected annotations %v", annotations)
+	}
+}
+
+func TestNewObjectMetaTemplates_invalid(t *testing.T) {
+	if _, err := NewObjectMetaTemplates(map[string]string{"bad key!": "x"}, nil); err == nil {
+		t.Error("invalid label key accepted")
+	}
+
+	if _, err := NewObjectMetaTemplates(nil, map[string]string{"key": "{{ .Missing"}); err == nil {
+		t.Error("invalid template accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package kubernetes
+
+import (
+	v13 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sisyphus/cache"
+	"sisyphus/executor"
+	"sisyphus/protocol"
+	"strings"
+)
+
+// Objects that would be created for a gitlab job. The token secret is left out,
+// so the builder refers to signed cache URLs which are not in the output
+type JobManifests struct {
+	Script    string
+	ConfigMap *v1.ConfigMap
+	Pvc       *v1.PersistentVolumeClaim
+	Job       *v13.Job
+}
+
+// Generate the objects of a gitlab job without creating them.
+// Generated names are assigned by K8S, so the objects are named after the name prefix instead
+func RenderGitLabJob(spec *protocol.JobSpec, k8sJobParams *executor.JobParameters, cacheSettings *cache.Settings) (*JobManifests, error) {
+	qCpu, script, err := prepareJob(spec, k8sJobParams, cacheSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	namePrefix := JobNamePrefix(spec)
+	objectMeta := newObjectMeta(namePrefix, spec, k8sJobParams)
+	objectMeta.GenerateName = ""
+	objectMeta.Name = strings.TrimSuffix(namePrefix, "-")
+
+	configMap := newEntryPointScript(objectMeta, script.Text)
+	configMap.TypeMeta = v12.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}
+
+	pvc := newPvc(objectMeta, k8sJobParams.ResourceRequest[v1.ResourceStorage])
+	pvc.TypeMeta = v12.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+
+	job := jobFromGitHubSpec(objectMeta, spec, k8sJobParams.ActiveDeadlineSec, k8sJobParams.NodeSelector, qCpu,
+		configMap.Name, pvc.Name, objectMeta.Name)
+	job.TypeMeta = v12.TypeMeta{APIVersion: "batch/v1", Kind: "Job"}
+	addCacheVolume(job, k8sJobParams)
+	addSecretEnv(job, objectMeta.Name, script.SecretEnv)
+
+	return &JobManifests{
+		Script:    script.Text,
+		ConfigMap: configMap,
+		Pvc:       pvc,
+		Job:       job,
+	}, nil
+}
@@ -0,0 +1,57 @@
+package kubernetes
+
+import (
+	"testing"
+)
+
+func TestRenderGitLabJob(t *testing.T) {
+	manifests, err := RenderGitLabJob(newTestJobSpec(), newTestJobParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifests.ConfigMap.Data["entrypoint.sh"] != manifests.Script {
+		t.Error("configmap does not contain the entrypoint script")
+	}
+
+	if manifests.Job.Name != "sphs-7-42" || manifests.Job.GenerateName != "" {
+		t.Errorf("unexpected job name '%s', generate name '%s'", manifests.Job.Name, manifests.Job.GenerateName)
+	}
+
+	volumes := manifests.Job.Spec.Template.Spec.Volumes
+	if volumes[0].ConfigMap.Name != manifests.ConfigMap.Name || volumes[1].PersistentVolumeClaim.ClaimName != manifests.Pvc.Name {
+		t.Errorf("job volumes do not reference rendered objects: %v", volumes)
+	}
+
+	if manifests.Job.Kind != "Job" || manifests.Pvc.Kind != "PersistentVolumeClaim" || manifests.ConfigMap.Kind != "ConfigMap" {
+		t.Error("rendered objects have no kind")
+	}
+}
+
+func TestRenderGitLabJob_cacheVolume(t *testing.T) {
+	params := newTestJobParams()
+	params.CacheVolumeClaim = "ci-cache"
+	params.CacheVolumePath = "/cache"
+
+	manifests, err := RenderGitLabJob(newTestJobSpec(), params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	podSpec := manifests.Job.Spec.Template.Spec
+	volume := podSpec.Volumes[len(podSpec.Volumes)-1]
+	if volume.PersistentVolumeClaim == nil || volume.PersistentVolumeClaim.ClaimName != "ci-cache" {
+		t.Errorf("cache volume is missing: %v", podSpec.Volumes)
+	}
+
+	for _, c := range podSpec.Containers {
+		if c.Name != ContainerNameBuilder {
+			continue
+		}
+
+		mount := c.VolumeMounts[len(c.VolumeMounts)-1]
+		if mount.Name != volume.Name || mount.MountPath != "/cache" {
+			t.Errorf("cache volume is not mounted into the builder: %v", c.VolumeMounts)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sisyphus/executor"
+	"sisyphus/metrics"
+	"sisyphus/protocol"
+	"strconv"
+	"time"
+)
+
+// Keys of the token secret
+const (
+	secretKeyToken        = "token"
+	secretKeyMaskedValues = "masked-values"
+)
+
+// Job left running by the previous instance of the runner
+type ResumableJob struct {
+	Job          *Job
+	GitLabJobId  int
+	ProjectId    int
+	Token        string
+	MaskedValues []string
+	Checkpoint   executor.TraceCheckpoint
+}
+
+// Secret with credentials needed to resume monitoring of the job
+// and the secret environment of the job script, keyed by the variable names
+func newTokenSecret(objectMeta metav1.ObjectMeta, spec *protocol.JobSpec, secretEnv map[string]string) (*v1.Secret, error) {
+	masked, err := json.Marshal(protocol.GetSecretValues(spec))
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{
+		secretKeyToken:        []byte(spec.Token),
+		secretKeyMaskedValues: masked,
+	}
+	for name, val := range secretEnv {
+		data[name] = []byte(val)
+	}
+
+	return &v1.Secret{
+		ObjectMeta: *objectMeta.DeepCopy(),
+
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}, nil
+}
+
+// Find jobs created by the runner in the namespace of the session.
+// Jobs labeled by other runners sharing the namespace are left alone, jobs of older versions have no runner label
+func (s *Session) ListResumableJobs(runnerName string) ([]*ResumableJob, error) {
+	jobList, err := s.k8sClient.BatchV1().Jobs(s.Namespace).List(metav1.ListOptions{LabelSelector: LabelGitLabJobId})
+	if err != nil {
+		return nil, err
+	}
+
+	runnerLabel := SanitizeLabelValue(runnerName)
+	result := make([]*ResumableJob, 0, len(jobList.Items))
+	for i := range jobList.Items {
+		if runner, ok := jobList.Items[i].Labels[LabelRunner]; ok && runner != runnerLabel {
+			continue
+		}
+
+		rj, err := s.loadResumableJob(&jobList.Items[i])
+		if err != nil {
+			metrics.K8SErrors.WithLabelValues(metrics.OpResumeJob).Inc()
+			logrus.Warnf("Can not resume job '%s': %v", jobList.Items[i].Name, err)
+			continue
+		}
+
+		result = append(result, rj)
+	}
+
+	return result, nil
+}
+
+func (s *Session) loadResumableJob(k8sJob *batchv1.Job) (*ResumableJob, error) {
+	gitlabJobId, err := strconv.Atoi(k8sJob.Labels[LabelGitLabJobId])
+	if err != nil {
+		return nil, fmt.Errorf("invalid label %s: %v", LabelGitLabJobId, err)
+	}
+
+	// jobs created by older versions have no project label
+	projectId, _ := strconv.Atoi(k8sJob.Labels[LabelGitLabProjectId])
+
+	secretName, ok := k8sJob.Annotations[AnnotationTokenSecret]
+	if !ok {
+		return nil, errors.New("token secret annotation is missing")
+	}
+
+	secret, err := s.k8sClient.CoreV1().Secrets(s.Namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var masked []string
+	err = json.Unmarshal(secret.Data[secretKeyMaskedValues], &masked)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResumableJob{
+		Job: &Job{
+			session:        s,
+			k8sJob:         k8sJob,
+			k8sTokenSecret: secret,
+			k8sClient:      s.k8sClient,
+			namespace:      s.Namespace,
+			Name:           k8sJob.Name,
+		},
+		GitLabJobId:  gitlabJobId,
+		ProjectId:    projectId,
+		Token:        string(secret.Data[secretKeyToken]),
+		MaskedValues: masked,
+		Checkpoint:   parseTraceCheckpoint(secret.Annotations),
+	}, nil
+}
+
+// Missing or malformed annotations mean that the trace starts from the beginning
+func parseTraceCheckpoint(annotations map[string]string) executor.TraceCheckpoint {
+	var cp executor.TraceCheckpoint
+
+	if offset, err := strconv.Atoi(annotations[AnnotationTraceOffset]); err == nil {
+		cp.Offset = offset
+	}
+
+	if ts, err := time.Parse(time.RFC3339Nano, annotations[AnnotationTraceTimestamp]); err == nil {
+		cp.LastTimestamp = &ts
+	}
+
+	return cp
+}
+
+// Save trace progress to the token secret
+func (j *Job) SaveTraceCheckpoint(cp executor.TraceCheckpoint) error {
+	if j.k8sTokenSecret == nil {
+		return errors.New("job has no token secret")
+	}
+
+	annotations := map[string]string{
+		AnnotationTraceOffset: strconv.Itoa(cp.Offset),
+	}
+	if cp.LastTimestamp != nil {
+		annotations[AnnotationTraceTimestamp] = cp.LastTimestamp.Format(time.RFC3339Nano)
+	}
+
+	patchData, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = j.k8sClient.CoreV1().Secrets(j.namespace).Patch(j.k8sTokenSecret.Name, types.MergePatchType, patchData)
+	return err
+}
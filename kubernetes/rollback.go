@@ -0,0 +1,61 @@
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Objects created for a job so far.
+// If a later step fails they are deleted, because they have no owner which would garbage collect them
+type createdObjects struct {
+	k8sClient kubernetes.Interface
+	namespace string
+
+	secrets    []string
+	configMaps []string
+	pvcs       []string
+	jobs       []string
+}
+
+func newCreatedObjects(k8sClient kubernetes.Interface, namespace string) *createdObjects {
+	return &createdObjects{
+		k8sClient: k8sClient,
+		namespace: namespace,
+	}
+}
+
+// Delete all created objects. Jobs go first, so no pod is using the volumes
+func (c *createdObjects) rollback() {
+	prop := metav1.DeletePropagationBackground
+	opts := &metav1.DeleteOptions{PropagationPolicy: &prop}
+
+	for _, name := range c.jobs {
+		err := c.k8sClient.BatchV1().Jobs(c.namespace).Delete(name, opts)
+		logRollback("job", name, err)
+	}
+
+	for _, name := range c.pvcs {
+		err := c.k8sClient.CoreV1().PersistentVolumeClaims(c.namespace).Delete(name, opts)
+		logRollback("pvc", name, err)
+	}
+
+	for _, name := range c.configMaps {
+		err := c.k8sClient.CoreV1().ConfigMaps(c.namespace).Delete(name, opts)
+		logRollback("configmap", name, err)
+	}
+
+	for _, name := range c.secrets {
+		err := c.k8sClient.CoreV1().Secrets(c.namespace).Delete(name, opts)
+		logRollback("secret", name, err)
+	}
+}
+
+func logRollback(kind string, name string, err error) {
+	if err != nil {
+		logrus.Error(fmt.Sprintf("Rollback: failed to delete %s '%s': %v", kind, name, err))
+	} else {
+		logrus.Infof("Rollback: deleted %s '%s'", kind, name)
+	}
+}
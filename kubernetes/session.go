@@ -6,6 +6,8 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
 	"path/filepath"
+	"sisyphus/cache"
+	"sisyphus/executor"
 	"sisyphus/protocol"
 
 	// GCP Auth provider
@@ -16,7 +18,7 @@ import (
 type Session struct {
 	// Kubernetes namespace where all objects will be created
 	Namespace string
-	k8sClient *kubernetes.Clientset
+	k8sClient kubernetes.Interface
 }
 
 // Start new kubernetes session with configuration from home directory
@@ -46,21 +48,32 @@ func CreateK8SSession(inCluster bool, namespace string) (*Session, error) {
 		return nil, err
 	}
 
+	return NewSession(clientset, namespace), nil
+}
+
+// Session with the given client, for example the fake clientset of client-go in tests
+func NewSession(client kubernetes.Interface, namespace string) *Session {
 	return &Session{
 		Namespace: namespace,
-		k8sClient: clientset,
-	}, nil
+		k8sClient: client,
+	}
 }
 
 // Create new job template
-func (s *Session) CreateGitLabJob(namePrefix string, spec *protocol.JobSpec, k8sJobParams *K8SJobParameters, cacheBucket string) (*Job, error) {
-	job, err := newJobFromGitLab(s, namePrefix, spec, k8sJobParams, cacheBucket)
+func (s *Session) CreateGitLabJob(namePrefix string, spec *protocol.JobSpec, k8sJobParams *executor.JobParameters, cacheSettings *cache.Settings) (*Job, error) {
+	job, err := newJobFromGitLab(s, namePrefix, spec, k8sJobParams, cacheSettings)
 	if err != nil {
 		return nil, err
 	}
 	return job, nil
 }
 
+// Check that the API server is reachable with the credentials of the session
+func (s *Session) Ping() error {
+	_, err := s.k8sClient.Discovery().ServerVersion()
+	return err
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
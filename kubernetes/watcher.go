@@ -0,0 +1,182 @@
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"sisyphus/metrics"
+	"sync"
+	"time"
+)
+
+// Full resync of the informer caches, changes are normally delivered by watches
+const watcherResyncPeriod = 5 * time.Minute
+
+// Informers do not return their list and watch errors, they report them to the global error handlers
+var countWatchErrors sync.Once
+
+// Shared informers for jobs and pods created by sisyphus.
+// Job monitors read the status from the informer caches and are notified about changes,
+// so there is no per job polling of the API
+type JobWatcher struct {
+	namespace string
+	jobLister batchlisters.JobLister
+	podLister corelisters.PodLister
+
+	subscribersMux sync.Mutex
+	subscribers    map[types.UID]chan struct{}
+}
+
+// Start informers for objects labeled by sisyphus. The informers run until stopChan is closed
+func (s *Session) NewJobWatcher(stopChan <-chan bool) (*JobWatcher, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.k8sClient, watcherResyncPeriod,
+		informers.WithNamespace(s.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = LabelGitLabJobId
+		}))
+
+	countWatchErrors.Do(func() {
+		utilruntime.ErrorHandlers = append(utilruntime.ErrorHandlers, func(error) {
+			metrics.K8SErrors.WithLabelValues(metrics.OpWatch).Inc()
+		})
+	})
+
+	jobInformer := factory.Batch().V1().Jobs()
+	podInformer := factory.Core().V1().Pods()
+
+	w := &JobWatcher{
+		namespace:   s.Namespace,
+		jobLister:   jobInformer.Lister(),
+		podLister:   podInformer.Lister(),
+		subscribers: make(map[types.UID]chan struct{}),
+	}
+
+	jobInformer.Informer().AddEventHandler(w.eventHandler(func(obj metav1.Object) types.UID {
+		return obj.GetUID()
+	}))
+
+	podInformer.Informer().AddEventHandler(w.eventHandler(func(obj metav1.Object) types.UID {
+		if owner := metav1.GetControllerOf(obj); owner != nil {
+			return owner.UID
+		}
+		return ""
+	}))
+
+	// informers take struct{} channel
+	stop := make(chan struct{})
+	go func() {
+		<-stopChan
+		close(stop)
+	}()
+
+	factory.Start(stop)
+	for informerType, ok := range factory.WaitForCacheSync(stop) {
+		if !ok {
+			return nil, fmt.Errorf("failed to sync informer cache for %v", informerType)
+		}
+	}
+
+	logrus.Infof("Watching jobs in namespace %s", s.Namespace)
+	return w, nil
+}
+
+// Route informer events to the subscriber of the K8S job with the given uid
+func (w *JobWatcher) eventHandler(jobUid func(obj metav1.Object) types.UID) cache.ResourceEventHandler {
+	notify := func(obj interface{}) {
+		// deleted objects may come as tombstones
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return
+		}
+
+		w.notify(jobUid(objMeta))
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, newObj interface{}) { notify(newObj) },
+		DeleteFunc: notify,
+	}
+}
+
+func (w *JobWatcher) notify(uid types.UID) {
+	if len(uid) == 0 {
+		return
+	}
+
+	w.subscribersMux.Lock()
+	defer w.subscribersMux.Unlock()
+
+	ch, ok := w.subscribers[uid]
+	if !ok {
+		return
+	}
+
+	// the subscriber reads the latest status anyway, pending notification is enough
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe to status changes of the job. The returned function cancels the subscription
+func (w *JobWatcher) Subscribe(job *Job) (<-chan struct{}, func()) {
+	uid := job.k8sJob.UID
+	ch := make(chan struct{}, 1)
+
+	w.subscribersMux.Lock()
+	w.subscribers[uid] = ch
+	w.subscribersMux.Unlock()
+
+	return ch, func() {
+		w.subscribersMux.Lock()
+		delete(w.subscribers, uid)
+		w.subscribersMux.Unlock()
+	}
+}
+
+// Some monitor is subscribed to the job
+func (w *JobWatcher) IsMonitored(job metav1.Object) bool {
+	w.subscribersMux.Lock()
+	defer w.subscribersMux.Unlock()
+
+	_, ok := w.subscribers[job.GetUID()]
+	return ok
+}
+
+// Get job status from the informer caches
+func (w *JobWatcher) GetK8SJobStatus(job *Job) (*K8SJobStatus, error) {
+	sj, err := w.jobLister.Jobs(w.namespace).Get(job.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{LabelGitLabJobId: sj.Labels[LabelGitLabJobId]})
+	podList, err := w.podLister.Pods(w.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lister returns shared objects, the monitor gets copies
+	pods := make([]v1.Pod, 0, len(podList))
+	for _, p := range podList {
+		if owner := metav1.GetControllerOf(p); owner != nil && owner.UID == sj.UID {
+			pods = append(pods, *p)
+		}
+	}
+
+	return newK8SJobStatus(sj.DeepCopy(), pods), nil
+}
@@ -0,0 +1,70 @@
+package kubernetes
+
+import (
+	"k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestJobWatcher(t *testing.T) {
+	session, client := newFakeSession()
+
+	job, err := newJobFromGitLab(session, "sphs-7-42-", newTestJobSpec(), newTestJobParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	watcher, err := session.NewJobWatcher(stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statusChanged, unsubscribe := watcher.Subscribe(job)
+	defer unsubscribe()
+
+	status, err := watcher.GetK8SJobStatus(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status.Pods) != 0 || status.PodPhases[ContainerNameBuilder] != v1.PodUnknown {
+		t.Errorf("unexpected status of job without pods %+v", status)
+	}
+
+	isController := true
+	pod := &v1.Pod{
+		ObjectMeta: v12.ObjectMeta{
+			Name:   job.Name + "-pod",
+			Labels: job.k8sJob.Spec.Template.Labels,
+			OwnerReferences: []v12.OwnerReference{
+				{Kind: "Job", Name: job.Name, UID: job.k8sJob.UID, Controller: &isController},
+			},
+		},
+		Spec:   job.k8sJob.Spec.Template.Spec,
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+
+	_, err = client.CoreV1().Pods(testNamespace).Create(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-statusChanged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification about the new pod")
+	}
+
+	status, err = watcher.GetK8SJobStatus(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status.Pods) != 1 || status.PodPhases[ContainerNameBuilder] != v1.PodRunning {
+		t.Errorf("unexpected status of running job %+v", status)
+	}
+}
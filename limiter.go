@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sisyphus/conf"
+	"sync"
+)
+
+// Tracks jobs against the global and per project concurrency limits.
+// A job is counted from the moment it is received from gitlab until its goroutine finishes
+type jobLimiter struct {
+	mux sync.Mutex
+
+	concurrent        int
+	projectConcurrent int
+	projectLimits     map[int]int
+
+	// received and not finished jobs, running or queued
+	total int
+	// running jobs per project id
+	running map[int]int
+}
+
+func newJobLimiter(sConf *conf.SisyphusConf) *jobLimiter {
+	return &jobLimiter{
+		concurrent:        sConf.Concurrent,
+		projectConcurrent: sConf.ProjectConcurrent,
+		projectLimits:     sConf.ProjectLimits,
+		running:           make(map[int]int),
+	}
+}
+
+// Check if the runner can take more jobs. Gitlab can not be asked for jobs of other projects only,
+// so jobs waiting for their project limit count against the global limit and do not stop other projects
+func (l *jobLimiter) hasCapacity() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.concurrent <= 0 || l.total < l.concurrent
+}
+
+// Count received job
+func (l *jobLimiter) add() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.total++
+}
+
+// Mark the job of the project as running, if the project is below its limit
+func (l *jobLimiter) tryStart(projectId int) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	limit, ok := l.projectLimits[projectId]
+	if !ok {
+		limit = l.projectConcurrent
+	}
+
+	if limit > 0 && l.running[projectId] >= limit {
+		return false
+	}
+
+	l.running[projectId]++
+	return true
+}
+
+// Mark the job of the project as running regardless of the project limit
+func (l *jobLimiter) start(projectId int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.running[projectId]++
+}
+
+// Release the slot of finished job
+func (l *jobLimiter) finish(projectId int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.total--
+	l.running[projectId]--
+	if l.running[projectId] <= 0 {
+		delete(l.running, projectId)
+	}
+}
+
+// Number of received and not finished jobs
+func (l *jobLimiter) count() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.total
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sisyphus/conf"
+	"testing"
+)
+
+func TestJobLimiter(t *testing.T) {
+	l := newJobLimiter(&conf.SisyphusConf{
+		Concurrent:        3,
+		ProjectConcurrent: 1,
+		ProjectLimits:     map[int]int{7: 2},
+	})
+
+	for i := 0; i < 3; i++ {
+		if !l.hasCapacity() {
+			t.Fatalf("no capacity for job %d", i)
+		}
+		l.add()
+	}
+
+	if l.hasCapacity() {
+		t.Error("runner is over the global limit")
+	}
+
+	if !l.tryStart(1) || l.tryStart(1) {
+		t.Error("project 1 must be limited to one job")
+	}
+
+	if !l.tryStart(7) || !l.tryStart(7) || l.tryStart(7) {
+		t.Error("project 7 must be limited to two jobs")
+	}
+
+	l.finish(7)
+	if !l.hasCapacity() || !l.tryStart(7) {
+		t.Error("finished job must release its slots")
+	}
+
+	if l.count() != 2 {
+		t.Errorf("expected 2 jobs, got %d", l.count())
+	}
+
+	// A job waiting for its project takes a slot of the runner, other projects are not blocked
+	l = newJobLimiter(&conf.SisyphusConf{Concurrent: 3, ProjectConcurrent: 1})
+	l.add()
+	l.start(1)
+	l.add()
+	if l.tryStart(1) || !l.hasCapacity() {
+		t.Error("queued job of project 1 must not block other projects")
+	}
+
+	l.add()
+	if !l.tryStart(2) || l.hasCapacity() {
+		t.Error("queued job must count against the global limit")
+	}
+}
@@ -5,14 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	v1 "k8s.io/api/core/v1"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sisyphus/cache"
 	"sisyphus/conf"
+	"sisyphus/executor"
+	"sisyphus/health"
 	"sisyphus/jobmon"
 	"sisyphus/kubernetes"
+	"sisyphus/metrics"
 	"sisyphus/protocol"
 	"sisyphus/shell"
 	"strconv"
@@ -82,6 +89,12 @@ func initAppLogger(json bool) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	log.Info("Hello.")
 	var inCluster = false
 	var gceProfiler = false
@@ -105,15 +118,20 @@ func main() {
 	}
 
 	// Parse request quantities
-	var defaultRequests v1.ResourceList
-	if len(sConf.DefaultResourceRequest) > 0 {
-		defaultRequests, err = conf.ParseResourceQuantity(sConf.DefaultResourceRequest)
-		if err != nil {
-			log.Panic(err)
-		}
+	defaultRequests, err := parseDefaultResourceRequest(sConf)
+	if err != nil {
+		log.Panic(err)
 	}
 
-	if err = conf.ValidateDefaultResourceQuantity(defaultRequests); err != nil {
+	// Storage of job caches
+	cacheSettings, err := cache.NewSettings(sConf)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Labels and annotations of job objects
+	objectMetaTemplates, err := kubernetes.NewObjectMetaTemplates(sConf.ExtraLabels, sConf.ExtraAnnotations)
+	if err != nil {
 		log.Panic(err)
 	}
 
@@ -125,67 +143,309 @@ func main() {
 	// Channel used to inform goroutines that the service is shutting down
 	stopChan := make(chan bool)
 
+	// Channel used to stop taking new jobs, running jobs are monitored until they finish
+	drainChan := make(chan bool)
+
+	// Channel used to fail running jobs when draining is over
+	killChan := make(chan bool)
+
 	// Global rate limiter for gitlab log PATCH-er
 	tickGitLabLog := time.NewTicker(100 * time.Millisecond)
 	defer tickGitLabLog.Stop()
 
-	// Queue for new jobs from gitlab
+	// Shared by all jobs. The local executor runs without K8S
+	var k8sSession *kubernetes.Session
+	k8sCheck := func() error { return nil }
+	switch sConf.Executor {
+	case "", conf.ExecutorKubernetes:
+		k8sSession, err = kubernetes.CreateK8SSession(inCluster, sConf.K8SNamespace)
+		if err != nil {
+			log.Panic(err)
+		}
+		k8sCheck = k8sSession.Ping
+
+	case conf.ExecutorLocal:
+		log.Warn("Jobs run as local processes, use the local executor for development only")
+
+	default:
+		log.Panicf("unknown executor '%s'", sConf.Executor)
+	}
+
+	// Liveness and readiness of the runner
+	healthMon := health.NewMonitor(health.DefaultPollTimeout, k8sCheck)
+
+	// Metrics and probes
+	if len(sConf.HttpAddress) > 0 {
+		err = startHttpServer(sConf.HttpAddress, sConf.RunnerName, healthMon)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	// Concurrency limits. Finished job goroutines report their project id
+	limiter := newJobLimiter(sConf)
+	jobDone := make(chan int)
+	startJob := func(projectId int, run func()) {
+		metrics.JobsRunning.Inc()
+		go func() {
+			defer func() { jobDone <- projectId }()
+			defer metrics.JobsRunning.Dec()
+			run()
+		}()
+	}
+
+	// Backend running the jobs
+	var backend executor.Executor
+	if k8sSession != nil {
+		// Status of all jobs is watched by shared informers
+		watcher, err := k8sSession.NewJobWatcher(stopChan)
+		if err != nil {
+			log.Panic(err)
+		}
+		backend = jobmon.NewK8SExecutor(k8sSession, watcher)
+
+		// Jobs left running by the previous instance of the runner
+		for _, rj := range findResumableJobs(k8sSession, sConf.RunnerName) {
+			rj := rj
+			limiter.add()
+			limiter.start(rj.ProjectId)
+			startJob(rj.ProjectId, func() { jobmon.ResumeJob(rj, watcher, httpSession, stopChan, killChan, tickGitLabLog) })
+		}
+
+		// The first collection runs after resumed jobs are monitored
+		if sConf.OrphanTTLSec > 0 {
+			go k8sSession.RunOrphanCollector(watcher, sConf.RunnerName, time.Duration(sConf.OrphanTTLSec)*time.Second, stopChan)
+		}
+	} else {
+		buildDir := sConf.LocalBuildDir
+		if len(buildDir) == 0 {
+			buildDir = filepath.Join(os.TempDir(), "sisyphus")
+		}
+		backend = jobmon.NewLocalExecutor(buildDir, stopChan)
+	}
+
+	runJob := func(j *protocol.JobSpec) {
+		projectId := j.JobInfo.ProjectId
+
+		// Parse custom job parameters passed via env variables
+		vars := protocol.GetEnvVars(j)
+		resReq, err := loadCustomK8SJobParams(vars, defaultRequests, sConf.DefaultNodeSelector)
+		if err != nil {
+			log.Error(err)
+			startJob(projectId, func() { jobmon.FailJob(j, httpSession, protocol.ConfigFailure, err) })
+			return
+		}
+
+		resReq.Labels, resReq.Annotations, err = objectMetaTemplates.Render(kubernetes.NewJobMetadata(sConf.RunnerName, j))
+		if err != nil {
+			log.Error(err)
+			startJob(projectId, func() { jobmon.FailJob(j, httpSession, protocol.RunnerSystemFailure, err) })
+			return
+		}
+		setCacheVolume(resReq, &sConf.Cache)
+
+		jobCache := expireJobCache(scopeJobCache(cacheSettings, &sConf.Cache, j), &sConf.Cache, j, resReq)
+		startJob(projectId, func() {
+			jobmon.RunJob(j, backend, resReq, httpSession, jobCache, stopChan, killChan, tickGitLabLog)
+		})
+	}
+
+	// Jobs received from gitlab, waiting for their project to get below its limit
+	var queuedJobs []*protocol.JobSpec
+	runQueuedJobs := func() {
+		remaining := queuedJobs[:0]
+		for _, j := range queuedJobs {
+			if limiter.tryStart(j.JobInfo.ProjectId) {
+				runJob(j)
+			} else {
+				remaining = append(remaining, j)
+			}
+		}
+		queuedJobs = remaining
+	}
+
+	// Queued jobs would stay running in gitlab until they time out.
+	// Running jobs are detached to be resumed by the next instance of the runner, or failed when draining is over
+	stop := func(kill bool) {
+		for _, j := range queuedJobs {
+			jobmon.FailJob(j, httpSession, protocol.RunnerSystemFailure, errors.New("runner stopped before the job was started"))
+		}
+
+		if kill {
+			stopRunner(killChan)
+		} else {
+			stopRunner(stopChan)
+		}
+	}
+
+	// Queue for new jobs from gitlab. Closed when the fetch loop terminates
 	newJobs := make(chan *protocol.JobSpec, BurstLimit)
-	go nextJobLoop(httpSession, sConf.RunnerToken, newJobs, stopChan)
+	go nextJobLoop(httpSession, sConf.RunnerToken, newJobs, limiter, healthMon, drainChan)
 
 	// Handle OS signals
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
+	draining := false
+	var drainTimeout <-chan time.Time
+
 	// Main event loop
 	for {
 		select {
-		case j := <-newJobs:
+		case j, ok := <-newJobs:
+			if !ok {
+				// no more jobs will be received
+				newJobs = nil
+				continue
+			}
+
 			ji := j.JobInfo
 			log.Infof("New job received. project=%s stage=%s name=%s", ji.ProjectName, ji.Stage, ji.Name)
+			metrics.JobsReceived.WithLabelValues(metrics.ProjectLabel(ji.ProjectId)).Inc()
 
-			// Parse custom job parameters passed via env variables
-			vars := protocol.GetEnvVars(j)
-			//noinspection GoShadowedVar
-			resReq, err := loadCustomK8SJobParams(vars, defaultRequests, sConf.DefaultNodeSelector)
-			if err != nil {
-				log.Error(err)
+			if !limiter.tryStart(ji.ProjectId) {
+				log.Infof("Project %s is at its limit, job %d is queued", ji.ProjectName, j.Id)
+				queuedJobs = append(queuedJobs, j)
 				continue
 			}
 
-			//noinspection GoShadowedVar
-			k8sSession, err := kubernetes.CreateK8SSession(inCluster, sConf.K8SNamespace)
-			if err != nil {
-				log.Error(err)
-			}
+			runJob(j)
 
-			go jobmon.RunJob(j, k8sSession, resReq, httpSession, sConf.GcpCacheBucket, stopChan, tickGitLabLog)
+		case projectId := <-jobDone:
+			limiter.finish(projectId)
+			runQueuedJobs()
+			if draining {
+				log.Infof("Draining, %d jobs are still running", limiter.count())
+			}
 
 		case s := <-signals:
 			log.Debugf("Signal received %v", s)
-			close(stopChan)
-			time.Sleep(5 * time.Second)
+			if draining || sConf.DrainTimeoutSec <= 0 {
+				stop(draining)
+				return
+			}
+
+			draining = true
+			healthMon.SetDraining()
+			close(drainChan)
+			drainTimeout = time.After(time.Duration(sConf.DrainTimeoutSec) * time.Second)
+			log.Infof("Draining for at most %d seconds, %d jobs are running. Send the signal again to fail them now",
+				sConf.DrainTimeoutSec, limiter.count())
+
+		case <-drainTimeout:
+			log.Warnf("Drain timeout, %d jobs are still running and are failed", limiter.count())
+			stop(true)
 			return
 
 		default:
+			// Drained when the fetch loop has terminated and all jobs are finished
+			if draining && newJobs == nil && limiter.count() == 0 {
+				log.Info("All jobs are finished")
+				return
+			}
+
 			time.Sleep(1 * time.Second)
 		}
 	}
 }
 
+// Stop monitoring of running jobs and give the goroutines time to detach or fail their jobs
+func stopRunner(stopChan chan bool) {
+	close(stopChan)
+	time.Sleep(5 * time.Second)
+}
+
+// Find K8S jobs created before the restart
+func findResumableJobs(k8sSession *kubernetes.Session, runnerName string) []*kubernetes.ResumableJob {
+	jobs, err := k8sSession.ListResumableJobs(runnerName)
+	if err != nil {
+		metrics.K8SErrors.WithLabelValues(metrics.OpListJobs).Inc()
+		log.Error(err)
+		return nil
+	}
+
+	log.Infof("Found %d jobs to resume", len(jobs))
+	return jobs
+}
+
+// Caches of the job are scoped by its ref when configured
+func scopeJobCache(settings *cache.Settings, cacheConf *conf.CacheConf, spec *protocol.JobSpec) *cache.Settings {
+	if settings == nil || !cacheConf.ScopeByRef {
+		return settings
+	}
+
+	env := protocol.GetEnvVars(spec)
+	ref := env["CI_COMMIT_REF_SLUG"]
+	if len(ref) == 0 {
+		ref = spec.GitInfo.Ref
+	}
+
+	scoped := *settings
+	scoped.Backend = cache.ScopeByRef(settings.Backend, ref, env["CI_COMMIT_REF_PROTECTED"] == "true")
+	return &scoped
+}
+
+// Signed cache URLs of the job stay valid until the job is over: its timeout plus the time its pod may be pending,
+// which is bounded by the K8S deadline. The expiry configured for the runner applies to all jobs
+func expireJobCache(settings *cache.Settings, cacheConf *conf.CacheConf, spec *protocol.JobSpec, params *executor.JobParameters) *cache.Settings {
+	if settings == nil || cacheConf.UrlExpirySec > 0 {
+		return settings
+	}
+
+	timeout := time.Duration(spec.RunnerInfo.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = cache.DefaultUrlExpiry
+	}
+
+	result := *settings
+	result.Backend = cache.WithUrlExpiry(settings.Backend, timeout+time.Duration(params.ActiveDeadlineSec)*time.Second)
+	return &result
+}
+
+// The volume cache is mounted into the job pods
+func setCacheVolume(params *executor.JobParameters, cacheConf *conf.CacheConf) {
+	if cacheConf.Type != conf.CacheVolume {
+		return
+	}
+
+	params.CacheVolumeClaim = cacheConf.Volume.ClaimName
+	params.CacheVolumePath = cacheConf.Volume.MountPath
+	if len(params.CacheVolumePath) == 0 {
+		params.CacheVolumePath = cache.DefaultVolumeMountPath
+	}
+}
+
+// Default resource requests of jobs from configuration
+func parseDefaultResourceRequest(sConf *conf.SisyphusConf) (v1.ResourceList, error) {
+	var defaultRequests v1.ResourceList
+	var err error
+	if len(sConf.DefaultResourceRequest) > 0 {
+		defaultRequests, err = conf.ParseResourceQuantity(sConf.DefaultResourceRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = conf.ValidateDefaultResourceQuantity(defaultRequests); err != nil {
+		return nil, err
+	}
+
+	return defaultRequests, nil
+}
+
 //
 func loadCustomK8SJobParams(envVars map[string]string,
 	defaultResourceRequest v1.ResourceList,
-	defaultNodeSelector map[string]string) (*kubernetes.K8SJobParameters, error) {
+	defaultNodeSelector map[string]string) (*executor.JobParameters, error) {
 
-	var params = kubernetes.K8SJobParameters{}
+	var params = executor.JobParameters{}
 
 	// Custom resource requests merged with default ones
 	reqVal, ok := envVars[shell.SfsResourceRequest]
 	if ok {
 		req, err := parseCustomResourceRequests(reqVal)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid %s '%s': %v", shell.SfsResourceRequest, reqVal, err)
 		}
 
 		// Override with defaults
@@ -205,7 +465,7 @@ func loadCustomK8SJobParams(envVars map[string]string,
 	if ok {
 		dLine, err := strconv.ParseInt(dVal, 10, 64)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid %s '%s': %v", shell.SfsActiveDeadline, dVal, err)
 		}
 
 		params.ActiveDeadlineSec = dLine
@@ -219,7 +479,7 @@ func loadCustomK8SJobParams(envVars map[string]string,
 		customNodeSelector := make(map[string]string)
 		err := json.Unmarshal([]byte(nSel), &customNodeSelector)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid %s '%s': %v", shell.SfsNodeSelector, nSel, err)
 		}
 
 		params.NodeSelector = customNodeSelector
@@ -240,22 +500,33 @@ func parseCustomResourceRequests(envVal string) (v1.ResourceList, error) {
 	return resourceLst, err
 }
 
-// Check for next jobs
-func nextJobLoop(httpSession *protocol.RunnerHttpSession, runnerToken string, newJobs chan<- *protocol.JobSpec, stopChan <-chan bool) {
+// Check for next jobs while the runner is below the concurrency limit
+func nextJobLoop(httpSession *protocol.RunnerHttpSession, runnerToken string, newJobs chan<- *protocol.JobSpec,
+	limiter *jobLimiter, healthMon *health.Monitor, stopChan <-chan bool) {
 	log.Infof("Starting work fetch loop")
 	lmtTicker := time.NewTicker(1 * time.Second)
 	defer lmtTicker.Stop()
+	defer close(newJobs)
 
 	for {
 		select {
 		case <-lmtTicker.C:
-			for { // loop until there is no more jobs to run
+			healthMon.Heartbeat()
+			for limiter.hasCapacity() { // loop until there is no more jobs to run
+				start := time.Now()
 				nextJob, err := httpSession.PollNextJob(runnerToken)
+				metrics.PollDuration.Observe(time.Since(start).Seconds())
+				healthMon.GitLabRequestDone(err)
 				if err != nil {
+					metrics.PollErrors.Inc()
 					log.Warn(err)
 					break
 				} else if nextJob != nil {
+					limiter.add()
 					newJobs <- nextJob
+					if isClosed(stopChan) {
+						break
+					}
 					continue
 				} else {
 					break
@@ -269,6 +540,36 @@ func nextJobLoop(httpSession *protocol.RunnerHttpSession, runnerToken string, ne
 	}
 }
 
+// Non blocking check of a closed channel
+func isClosed(ch <-chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Serve /metrics, /healthz and /readyz in background
+func startHttpServer(address string, runnerName string, healthMon *health.Monitor) error {
+	err := metrics.Register(runnerName)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", healthMon.HealthzHandler())
+	mux.Handle("/readyz", healthMon.ReadyzHandler())
+
+	go func() {
+		log.Infof("Serving metrics and probes on %s", address)
+		log.Error(http.ListenAndServe(address, mux))
+	}()
+
+	return nil
+}
+
 func startGceProfiler(serviceName string) error {
 	profilerConf := profiler.Config{
 		Service: serviceName,
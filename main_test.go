@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sisyphus/cache"
+	"sisyphus/conf"
+	"sisyphus/executor"
+	"sisyphus/protocol"
+	"strings"
+	"testing"
+)
+
+func newTestCacheSettings(t *testing.T, cacheConf conf.CacheConf) *cache.Settings {
+	settings, err := cache.NewSettings(&conf.SisyphusConf{Cache: cacheConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return settings
+}
+
+func Test_scopeJobCache(t *testing.T) {
+	volumeConf := conf.CacheConf{Type: conf.CacheVolume, Volume: conf.VolumeCacheConf{ClaimName: "cache"}}
+	scoped := volumeConf
+	scoped.ScopeByRef = true
+
+	tests := []struct {
+		name      string
+		cacheConf conf.CacheConf
+		vars      []protocol.JobVariable
+		ref       string
+		want      string
+	}{
+		{"not scoped", volumeConf, nil, "feature/x", "/cache/project/key.tar.gz"},
+		{"ref slug", scoped, []protocol.JobVariable{{Key: "CI_COMMIT_REF_SLUG", Value: "feature-x"}}, "other", "/cache/non_protected/feature-x/project/key.tar.gz"},
+		{"git ref", scoped, nil, "Feature/X", "/cache/non_protected/feature-x/project/key.tar.gz"},
+		{"protected", scoped, []protocol.JobVariable{{Key: "CI_COMMIT_REF_PROTECTED", Value: "true"}}, "master", "/cache/protected/master/project/key.tar.gz"},
+		{"not protected", scoped, []protocol.JobVariable{{Key: "CI_COMMIT_REF_PROTECTED", Value: "false"}}, "master", "/cache/non_protected/master/project/key.tar.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &protocol.JobSpec{Variables: tt.vars, GitInfo: protocol.JobGitInfo{Ref: tt.ref}}
+
+			settings := scopeJobCache(newTestCacheSettings(t, tt.cacheConf), &tt.cacheConf, spec)
+			if location := settings.Backend.Location("project/key.tar.gz"); location != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, location)
+			}
+		})
+	}
+
+	if scopeJobCache(nil, &scoped, &protocol.JobSpec{}) != nil {
+		t.Error("missing cache is scoped")
+	}
+}
+
+func Test_expireJobCache(t *testing.T) {
+	s3Conf := conf.CacheConf{
+		Type: conf.CacheS3,
+		S3:   conf.S3CacheConf{Endpoint: "http://minio:9000", Bucket: "cache", AccessKey: "key", SecretKey: "secret"},
+	}
+	configured := s3Conf
+	configured.UrlExpirySec = 600
+
+	tests := []struct {
+		name      string
+		cacheConf conf.CacheConf
+		timeout   int
+		deadline  int64
+		want      string
+	}{
+		{"timeout and deadline", s3Conf, 7200, 3600, "X-Amz-Expires=10800"},
+		{"unknown timeout", s3Conf, 0, 3600, "X-Amz-Expires=25200"},
+		{"limited", s3Conf, 7 * 24 * 3600, 3600, "X-Amz-Expires=604800"},
+		{"configured", configured, 7200, 3600, "X-Amz-Expires=600"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &protocol.JobSpec{RunnerInfo: protocol.JobRunnerInfo{TimeoutSeconds: tt.timeout}}
+			params := &executor.JobParameters{ActiveDeadlineSec: tt.deadline}
+
+			settings := expireJobCache(newTestCacheSettings(t, tt.cacheConf), &tt.cacheConf, spec, params)
+			secretEnv := make(map[string]string)
+			_, err := settings.Backend.DownloadCommand("project/key.tar.gz", "/tmp/cache", secretEnv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(secretEnv) != 1 {
+				t.Fatalf("unexpected secret environment %v", secretEnv)
+			}
+			for _, url := range secretEnv {
+				if !strings.Contains(url, tt.want) {
+					t.Errorf("expected %s in %s", tt.want, url)
+				}
+			}
+		})
+	}
+}
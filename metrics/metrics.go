@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "sisyphus"
+
+// Final states of jobs
+const (
+	StatusSuccess  = "success"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+)
+
+// Job durations range from seconds to hours
+var jobDurationBuckets = prometheus.ExponentialBuckets(5, 2, 12)
+
+var (
+	JobsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_received_total",
+		Help:      "Jobs received from gitlab",
+	}, []string{"project"})
+
+	JobsRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jobs_running",
+		Help:      "Jobs handled by the runner",
+	})
+
+	JobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_finished_total",
+		Help:      "Finished jobs by status",
+	}, []string{"project", "status"})
+
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time from creation of the K8S job until the job is finished",
+		Buckets:   jobDurationBuckets,
+	}, []string{"project", "status"})
+
+	PodPendingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pod_pending_seconds",
+		Help:      "Time from creation of the K8S job until the builder is running",
+		Buckets:   jobDurationBuckets,
+	})
+
+	PollErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gitlab_poll_errors_total",
+		Help:      "Failed requests for new jobs",
+	})
+
+	PollDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gitlab_poll_duration_seconds",
+		Help:      "Latency of requests for new jobs",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	TraceBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gitlab_trace_bytes_total",
+		Help:      "Bytes of job trace sent to gitlab",
+	})
+
+	TraceErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gitlab_trace_errors_total",
+		Help:      "Failed job trace PATCH requests",
+	})
+
+	TraceDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gitlab_trace_duration_seconds",
+		Help:      "Latency of job trace PATCH requests",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	K8SErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "k8s_api_errors_total",
+		Help:      "Failed K8S API operations of jobs, informers, resume and orphan collection",
+	}, []string{"operation"})
+)
+
+// Operations for K8SErrors
+const (
+	OpCreateJob      = "create_job"
+	OpDeleteJob      = "delete_job"
+	OpListJobs       = "list_jobs"
+	OpStreamLog      = "stream_log"
+	OpSaveCheckpoint = "save_checkpoint"
+	OpResumeJob      = "resume_job"
+	OpWatch          = "watch"
+	OpListOrphans    = "list_orphans"
+	OpDeleteOrphan   = "delete_orphan"
+)
+
+// Register all metrics, labeled by the runner name
+func Register(runnerName string) error {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"runner": runnerName}, prometheus.DefaultRegisterer)
+
+	collectors := []prometheus.Collector{
+		JobsReceived, JobsRunning, JobsFinished, JobDuration, PodPendingDuration,
+		PollErrors, PollDuration,
+		TraceBytes, TraceErrors, TraceDuration,
+		K8SErrors,
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler for /metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Project ids are used as label values, names and paths can change
+func ProjectLabel(projectId int) string {
+	return strconv.Itoa(projectId)
+}
+
+// Count finished job. Duration is not known when the job could not be created
+func JobFinished(projectId int, status string, created time.Time) {
+	project := ProjectLabel(projectId)
+	JobsFinished.WithLabelValues(project, status).Inc()
+
+	if !created.IsZero() {
+		JobDuration.WithLabelValues(project, status).Observe(time.Since(created).Seconds())
+	}
+}
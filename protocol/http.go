@@ -52,6 +52,22 @@ const (
 	Success JobState = "success"
 )
 
+// The reason of job failure shown in gitlab
+type JobFailureReason string
+
+const (
+	NoFailure             JobFailureReason = ""
+	ScriptFailure         JobFailureReason = "script_failure"
+	StuckOrTimeoutFailure JobFailureReason = "stuck_or_timeout_failure"
+	RunnerSystemFailure   JobFailureReason = "runner_system_failure"
+	SchedulerFailure      JobFailureReason = "scheduler_failure"
+	ImagePullFailure      JobFailureReason = "image_pull_failure"
+
+	// GitLab has no dedicated reason for invalid job configuration, like malformed SFS_* variables.
+	// The variables are part of the job definition, so it is reported as a script failure
+	ConfigFailure = ScriptFailure
+)
+
 type FeaturesInfo struct {
 	Variables               bool `json:"variables"`
 	Image                   bool `json:"image"`
@@ -153,9 +169,8 @@ func newJobRequest(runnerToken string) *JobRequest {
 				Refspecs:                true,
 				Shared:                  true,
 				UploadMultipleArtifacts: true,
-
-				// TODO: add support for services
-				Services: false,
+				Services:                true,
+				Masking:                 true,
 			},
 		},
 	}
@@ -182,9 +197,10 @@ func jsonRequest(method string, requestUrl *url.URL, requestBody interface{}) (*
 
 type UpdateJobStateRequest struct {
 	//Info          VersionInfo      `json:"info,omitempty"`
-	Token string   `json:"token,omitempty"`
-	State JobState `json:"state,omitempty"`
-	//FailureReason JobFailureReason `json:"failure_reason,omitempty"`
+	Token         string           `json:"token,omitempty"`
+	State         JobState         `json:"state,omitempty"`
+	FailureReason JobFailureReason `json:"failure_reason,omitempty"`
+	ExitCode      int              `json:"exit_code,omitempty"`
 }
 
 type RemoteJobState struct {
@@ -192,11 +208,13 @@ type RemoteJobState struct {
 	RemoteState string
 }
 
-// Synchronize local and remote status of the job
-func (s *RunnerHttpSession) UpdateJobStatus(jobId int, jobToken string, state JobState) (*RemoteJobState, error) {
+// Synchronize local and remote status of the job. Failure reason and exit code are sent only if set
+func (s *RunnerHttpSession) UpdateJobStatus(jobId int, jobToken string, state JobState, failureReason JobFailureReason, exitCode int) (*RemoteJobState, error) {
 	request := UpdateJobStateRequest{
-		Token: jobToken,
-		State: state,
+		Token:         jobToken,
+		State:         state,
+		FailureReason: failureReason,
+		ExitCode:      exitCode,
 	}
 
 	path := fmt.Sprintf(PathJobState, jobId)
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"path"
+	"strings"
+)
+
+// Parts of a docker image reference, for example registry.example.com:5000/library/postgres:11
+type ImageName struct {
+	// Empty for images of docker hub
+	Registry string
+	// Path of the image in the registry, for example library/postgres
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Split the image reference. The first path component is the registry when it has a dot or a port, or it is localhost
+func ParseImageName(name string) ImageName {
+	result := ImageName{}
+
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		result.Digest = name[idx+1:]
+		name = name[:idx]
+	}
+
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		result.Tag = name[idx+1:]
+		name = name[:idx]
+	}
+
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		result.Registry = parts[0]
+		name = parts[1]
+	}
+
+	result.Repository = name
+	return result
+}
+
+// Last component of the repository, for example postgres
+func (n ImageName) ShortName() string {
+	return path.Base(n.Repository)
+}
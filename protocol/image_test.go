@@ -0,0 +1,26 @@
+package protocol
+
+import "testing"
+
+func TestParseImageName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected ImageName
+	}{
+		{"postgres", ImageName{Repository: "postgres"}},
+		{"postgres:11", ImageName{Repository: "postgres", Tag: "11"}},
+		{"tutum/wordpress:latest", ImageName{Repository: "tutum/wordpress", Tag: "latest"}},
+		{"registry.example.com/library/postgres:11", ImageName{Registry: "registry.example.com", Repository: "library/postgres", Tag: "11"}},
+		{"registry:5000/redis", ImageName{Registry: "registry:5000", Repository: "redis"}},
+		{"localhost/app:1@sha256:abc", ImageName{Registry: "localhost", Repository: "app", Tag: "1", Digest: "sha256:abc"}},
+		{"redis@sha256:abc", ImageName{Repository: "redis", Digest: "sha256:abc"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if parsed := ParseImageName(tt.name); parsed != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, parsed)
+			}
+		})
+	}
+}
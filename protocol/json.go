@@ -15,12 +15,44 @@ type JobVariable struct {
 	Masked bool   `json:"masked"`
 }
 
+type JobServicePort struct {
+	Number   int    `json:"number"`
+	Protocol string `json:"protocol"`
+	Name     string `json:"name"`
+}
+
+// Service container running next to the build container
+type JobService struct {
+	Name       string           `json:"name"`
+	Alias      string           `json:"alias"`
+	Entrypoint []string         `json:"entrypoint"`
+	Command    []string         `json:"command"`
+	Variables  []JobVariable    `json:"variables,omitempty"`
+	Ports      []JobServicePort `json:"ports,omitempty"`
+}
+
+// Condition for running a step or uploading an artifact
+type WhenCondition string
+
+const (
+	WhenUndefined WhenCondition = ""
+	WhenOnSuccess WhenCondition = "on_success"
+	WhenOnFailure WhenCondition = "on_failure"
+	WhenAlways    WhenCondition = "always"
+)
+
 type JobStep struct {
-	Name           string   `json:"name"`
-	Script         []string `json:"script"`
-	TimeoutSeconds int      `json:"timeout"`
-	When           string   `json:"when"`
-	AllowFailure   bool     `json:"allow_failure"`
+	Name           string        `json:"name"`
+	Script         []string      `json:"script"`
+	TimeoutSeconds int           `json:"timeout"`
+	When           WhenCondition `json:"when"`
+	AllowFailure   bool          `json:"allow_failure"`
+}
+
+// Settings of the runner for the job
+type JobRunnerInfo struct {
+	// Timeout of the job in seconds, configured in the project or in the runner
+	TimeoutSeconds int `json:"timeout"`
 }
 
 type CachePolicy string
@@ -29,20 +61,26 @@ const (
 	CachePolicyUndefined CachePolicy = ""
 	CachePolicyPullPush  CachePolicy = "pull-push"
 	CachePolicyPull      CachePolicy = "pull"
-	//CachePolicyPush      CachePolicy = "push"
+	CachePolicyPush      CachePolicy = "push"
 )
 
 type JobCache struct {
 	Key    string      `json:"key"`
 	Paths  []string    `json:"paths"`
 	Policy CachePolicy `json:"policy"`
+
+	// Tried in order when the archive of the key does not exist
+	FallbackKeys []string `json:"fallback_keys,omitempty"`
+
+	// Outcome of the job which uploads the cache, on_success by default
+	When WhenCondition `json:"when"`
 }
 
 type JobArtifact struct {
-	Name     string   `json:"name"`
-	Paths    []string `json:"paths"`
-	When     string   `json:"when"`
-	ExpireIn string   `json:"expire_in"`
+	Name     string        `json:"name"`
+	Paths    []string      `json:"paths"`
+	When     WhenCondition `json:"when"`
+	ExpireIn string        `json:"expire_in"`
 }
 
 type JobGitInfo struct {
@@ -72,9 +110,11 @@ type JobDependency struct {
 type JobSpec struct {
 	Id            int             `json:"id"`
 	JobInfo       JobInfo         `json:"job_info"`
+	RunnerInfo    JobRunnerInfo   `json:"runner_info"`
 	Token         string          `json:"token"`
 	AllowGitFetch bool            `json:"allow_git_fetch"`
 	Image         JobImage        `json:"image"`
+	Services      []JobService    `json:"services,omitempty"`
 	GitInfo       JobGitInfo      `json:"git_info"`
 	Variables     []JobVariable   `json:"variables,omitempty"`
 	Steps         []JobStep       `json:"steps,omitempty"`
@@ -116,6 +156,15 @@ func cleanupJobSpec(origSpec JobSpec) *JobSpec {
 	}
 	newSpec.Artifacts = cleanArtifacts
 
+	// Clean services
+	cleanServices := make([]JobService, 0, len(origSpec.Services))
+	for _, svc := range origSpec.Services {
+		if len(svc.Name) > 0 {
+			cleanServices = append(cleanServices, svc)
+		}
+	}
+	newSpec.Services = cleanServices
+
 	return &newSpec
 }
 
@@ -129,6 +178,23 @@ func GetEnvVars(spec *JobSpec) map[string]string {
 	return r
 }
 
+// Values which must never appear in the trace: job token, dependency tokens and masked variables
+func GetSecretValues(spec *JobSpec) []string {
+	result := []string{spec.Token}
+
+	for _, v := range spec.Variables {
+		if v.Masked {
+			result = append(result, v.Value)
+		}
+	}
+
+	for _, dep := range spec.Dependencies {
+		result = append(result, dep.Token)
+	}
+
+	return result
+}
+
 func ToFlatJson(v interface{}) (string, error) {
 	bytes, err := json.Marshal(v)
 	if err != nil {
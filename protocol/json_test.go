@@ -31,6 +31,14 @@ func Test_parse_X(t *testing.T) {
 	}
 
 	fmt.Println(spec)
+
+	if len(spec.Services) != 2 {
+		t.Errorf("expected 2 services, got %d", len(spec.Services))
+	}
+
+	if spec.RunnerInfo.TimeoutSeconds != 7200 {
+		t.Errorf("expected timeout 7200, got %d", spec.RunnerInfo.TimeoutSeconds)
+	}
 }
 
 func Test_resource(t *testing.T) {
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	PathRunners       = PathApi + "/runners"
+	PathRunnersVerify = PathRunners + "/verify"
+)
+
+// Gitlab rejected the registration or runner token
+var ErrForbidden = errors.New("token rejected by gitlab")
+
+type RegisterRunnerRequest struct {
+	Info        VersionInfo `json:"info,omitempty"`
+	Token       string      `json:"token"`
+	Description string      `json:"description,omitempty"`
+	TagList     []string    `json:"tag_list,omitempty"`
+	RunUntagged bool        `json:"run_untagged"`
+	Locked      bool        `json:"locked"`
+}
+
+type RegisterRunnerResponse struct {
+	Id    int    `json:"id"`
+	Token string `json:"token"`
+}
+
+type runnerTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// Register new runner with registration token of gitlab instance, group or project
+func (s *RunnerHttpSession) RegisterRunner(request RegisterRunnerRequest) (*RegisterRunnerResponse, error) {
+	request.Info = newJobRequest("").Info
+
+	resp, err := s.doJson(http.MethodPost, PathRunners, request)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		var result RegisterRunnerResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+
+		return &result, nil
+
+	case http.StatusForbidden:
+		return nil, ErrForbidden
+
+	default:
+		return nil, fmt.Errorf("unknown response code %v", resp.StatusCode)
+	}
+}
+
+// Check that the runner token is valid. Returns ErrForbidden for unknown tokens
+func (s *RunnerHttpSession) VerifyRunner(runnerToken string) error {
+	return s.runnerTokenRequest(http.MethodPost, PathRunnersVerify, runnerToken, http.StatusOK)
+}
+
+// Delete the runner from gitlab. Returns ErrForbidden for unknown tokens
+func (s *RunnerHttpSession) UnregisterRunner(runnerToken string) error {
+	return s.runnerTokenRequest(http.MethodDelete, PathRunners, runnerToken, http.StatusNoContent)
+}
+
+func (s *RunnerHttpSession) runnerTokenRequest(method string, path string, runnerToken string, expectedStatus int) error {
+	resp, err := s.doJson(method, path, runnerTokenRequest{Token: runnerToken})
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case expectedStatus:
+		return nil
+	case http.StatusForbidden:
+		return ErrForbidden
+	default:
+		return fmt.Errorf("unknown response code %v", resp.StatusCode)
+	}
+}
+
+// Send JSON request to the path under gitlab url
+func (s *RunnerHttpSession) doJson(method string, path string, body interface{}) (*http.Response, error) {
+	reqUrl, err := s.formatRequestUrl(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := jsonRequest(method, reqUrl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.client.Do(req)
+}
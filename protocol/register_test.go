@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Gitlab stand-in which knows one runner token
+func newRunnersServer(t *testing.T) *httptest.Server {
+	const validToken = "runner-token"
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == PathRunners:
+			if body["token"] != "registration-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if !reflect.DeepEqual(body["tag_list"], []interface{}{"k8s", "docker"}) || body["locked"] != true {
+				t.Errorf("unexpected registration %v", body)
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id": 12, "token": "` + validToken + `"}`))
+
+		case r.URL.Path == PathRunnersVerify && r.Method == http.MethodPost,
+			r.URL.Path == PathRunners && r.Method == http.MethodDelete:
+			if body["token"] != validToken {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if r.Method == http.MethodDelete {
+				w.WriteHeader(http.StatusNoContent)
+			}
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestRunnerHttpSession_RegisterRunner(t *testing.T) {
+	server := newRunnersServer(t)
+	defer server.Close()
+
+	session, err := NewHttpSession(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := session.RegisterRunner(RegisterRunnerRequest{
+		Token:   "registration-token",
+		TagList: []string{"k8s", "docker"},
+		Locked:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Id != 12 || resp.Token != "runner-token" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	_, err = session.RegisterRunner(RegisterRunnerRequest{Token: "wrong"})
+	if err != ErrForbidden {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+}
+
+func TestRunnerHttpSession_VerifyRunner(t *testing.T) {
+	server := newRunnersServer(t)
+	defer server.Close()
+
+	session, err := NewHttpSession(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = session.VerifyRunner("runner-token"); err != nil {
+		t.Errorf("valid token: %v", err)
+	}
+
+	if err = session.VerifyRunner("wrong"); err != ErrForbidden {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+
+	if err = session.UnregisterRunner("runner-token"); err != nil {
+		t.Errorf("unregister: %v", err)
+	}
+
+	if err = session.UnregisterRunner("wrong"); err != ErrForbidden {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"sisyphus/cache"
+	"sisyphus/protocol"
+	"strconv"
+	"strings"
+)
+
+// The checksum of the cache content is archived with the cache paths in this file, so both are replaced by one upload.
+// Signed headers would need the checksum when the URL is signed, before the job runs
+const cacheChecksumFile = ".sfs-cache-checksum"
+
+// Path of the cache archive in the storage. Job variables in the key are expanded.
+// The name is kept for archives of any format, so caches of older runners are restored
+func cacheKey(spec *protocol.JobSpec, key string, env map[string]string) string {
+	key = os.Expand(key, func(name string) string { return env[name] })
+	return fmt.Sprintf("%s/%s.tar.gz", spec.JobInfo.ProjectName, key)
+}
+
+// Variable with the checksum of the restored cache. Set only when the archive of the key itself was restored
+func cacheChecksumVar(index int) string {
+	return fmt.Sprintf("SFS_CACHE_CHECKSUM_%d", index)
+}
+
+// Archive format chosen by the job variables. The size limit of the runner applies to all jobs.
+// Format and level are checked together, when either is rejected the job keeps both settings of the runner
+func jobCacheSettings(settings *cache.Settings, env map[string]string) (*cache.Settings, string) {
+	if settings == nil {
+		return nil, ""
+	}
+
+	result := *settings
+	if format, ok := env[SfsCacheFormat]; ok && len(format) > 0 && format != settings.Format {
+		result.Format = format
+		result.Level = 0
+	}
+
+	if level, ok := env[SfsCacheCompressionLevel]; ok && len(level) > 0 {
+		l, err := strconv.Atoi(level)
+		if err != nil {
+			return settings, fmt.Sprintf("WARNING: invalid %s '%s', using the cache settings of the runner", SfsCacheCompressionLevel, level)
+		}
+		result.Level = l
+	}
+
+	err := cache.CheckFormat(result.Format, result.Level)
+	if err != nil {
+		return settings, fmt.Sprintf("WARNING: %s, using the cache settings of the runner", err)
+	}
+
+	return &result, ""
+}
+
+// Command creating the archive of the paths. Paths are not quoted, they may contain globs
+func archiveCommand(settings *cache.Settings, file string, paths []string) string {
+	level := ""
+	if settings.Level > 0 {
+		level = fmt.Sprintf(" -%d", settings.Level)
+	}
+
+	inFiles := strings.Join(paths, " ")
+	switch settings.Format {
+	case cache.FormatZstd:
+		return fmt.Sprintf("(set -o pipefail; tar -cf - %s | zstd -q -T0%s -c > %s)", inFiles, level, cache.Quote(file))
+	case cache.FormatNone:
+		return fmt.Sprintf("tar -cf %s %s", cache.Quote(file), inFiles)
+	default:
+		return fmt.Sprintf("(set -o pipefail; tar -cf - %s | gzip%s -c > %s)", inFiles, level, cache.Quote(file))
+	}
+}
+
+// Checksum of the names and contents of the cache paths. Archives are not reproducible, their checksums can not be compared.
+// Archives are extracted according to their magic bytes
+func (s *ScriptContext) printCacheFunctions() {
+	s.addLine(`sfs_cache_checksum() {
+  { find "$@" -print | LC_ALL=C sort; find "$@" -type f -print0 | LC_ALL=C sort -z | xargs -0 -r sha256sum; } 2>/dev/null | sha256sum | cut -d ' ' -f 1
+}
+sfs_cache_extract() {
+  case "$(head -c 4 "$1" | od -A n -t x1 | tr -d ' \n')" in
+    1f8b*) tar -zxf "$1" ;;
+    28b52ffd) (set -o pipefail; zstd -q -d -c "$1" | tar -xf -) ;;
+    *) tar -xf "$1" ;;
+  esac
+}`)
+}
+
+// Extract the archive of the first key which exists into the project dir. A missing archive is not an error.
+// Commands with signed URLs are not traced, the URLs are in the secret environment
+func (s *ScriptContext) printDownloadCache(settings *cache.Settings, index int, keys []string, file string) error {
+	if settings == nil {
+		s.addFline("echo %s", cache.Quote("Cache is not configured, skipping download of "+keys[0]))
+		return nil
+	}
+
+	backend := settings.Backend
+	s.addFline("echo %s", cache.Quote("Downloading cache from "+backend.Location(keys[0])))
+	for i, key := range keys {
+		download, err := backend.DownloadCommand(key, file, s.secretEnv)
+		if err != nil {
+			return err
+		}
+
+		keyword := "if"
+		if i > 0 {
+			keyword = "elif"
+		}
+
+		s.addFline("%s (set +x; %s) && sfs_cache_extract %s; then", keyword, download, cache.Quote(file))
+		s.addFline("  echo %s", cache.Quote("Cache hit, restored from "+backend.Location(key)))
+
+		// An unchanged cache is uploaded again only when it was restored from a fallback key
+		if i == 0 {
+			s.addFline("  if [ -f %s ]; then %s=$(cat %s); fi", cacheChecksumFile, cacheChecksumVar(index), cacheChecksumFile)
+		}
+	}
+
+	s.addLine("else")
+	s.addFline("  echo %s", cache.Quote("Cache miss, no archive found for "+strings.Join(keys, ", ")))
+	s.addLine("fi")
+	s.addFline("rm -f %s %s", cache.Quote(file), cacheChecksumFile)
+
+	return nil
+}
+
+// Archive the cache paths with their checksum and upload them, unless they did not change since the download
+// or the archive is too large. Failed uploads do not fail the job
+func (s *ScriptContext) printUploadCache(jobCache *protocol.JobCache, settings *cache.Settings, index int, key string, file string) error {
+	if settings == nil {
+		s.addFline("echo %s", cache.Quote("Cache is not configured, skipping upload of "+key))
+		return nil
+	}
+
+	backend := settings.Backend
+	upload, err := backend.UploadCommand(key, file, s.secretEnv)
+	if err != nil {
+		return err
+	}
+
+	location := backend.Location(key)
+	archivePaths := append(append([]string{}, jobCache.Paths...), cacheChecksumFile)
+
+	s.addFline("SFS_CACHE_CHECKSUM=$(sfs_cache_checksum %s)", strings.Join(jobCache.Paths, " "))
+	s.addFline(`if [ "${SFS_CACHE_CHECKSUM}" = "${%s:-}" ]; then`, cacheChecksumVar(index))
+	s.addFline("  echo %s", cache.Quote("Cache not changed, skipping upload to "+location))
+	s.addFline("elif ! { echo \"${SFS_CACHE_CHECKSUM}\" > %s && %s; }; then",
+		cacheChecksumFile, archiveCommand(settings, file, archivePaths))
+	s.addFline("  echo %s", cache.Quote("Failed to archive cache for "+location))
+	if settings.MaxSizeBytes > 0 {
+		s.addFline("elif [ $(wc -c < %s) -gt %d ]; then", cache.Quote(file), settings.MaxSizeBytes)
+		s.addFline("  echo \"WARNING: Cache archive of $(wc -c < %s) bytes exceeds the limit of %d bytes, skipping upload to \"%s",
+			cache.Quote(file), settings.MaxSizeBytes, cache.Quote(location))
+	}
+	s.addFline("elif (set +x; %s); then", upload)
+	s.addFline("  echo %s", cache.Quote("Cache uploaded to "+location))
+	s.addLine("else")
+	s.addFline("  echo %s", cache.Quote("Failed to upload cache to "+location))
+	s.addLine("fi")
+	s.addFline("rm -f %s %s", cache.Quote(file), cacheChecksumFile)
+
+	return nil
+}
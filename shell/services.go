@@ -0,0 +1,73 @@
+package shell
+
+import (
+	"fmt"
+	"sisyphus/cache"
+	"sisyphus/protocol"
+	"strconv"
+)
+
+const DefaultServiceWaitTimeoutSec = 60
+
+// Ports of popular service images. GitLab sends ports only if they are declared in .gitlab-ci.yml
+var wellKnownServicePorts = map[string][]int{
+	"postgres":      {5432},
+	"postgis":       {5432},
+	"mysql":         {3306},
+	"mariadb":       {3306},
+	"redis":         {6379},
+	"memcached":     {11211},
+	"mongo":         {27017},
+	"rabbitmq":      {5672},
+	"elasticsearch": {9200},
+	"docker":        {2375, 2376},
+}
+
+// Find ports to wait for. Declared ports take precedence over well known ones
+func servicePorts(svc *protocol.JobService) []int {
+	if len(svc.Ports) > 0 {
+		ports := make([]int, 0, len(svc.Ports))
+		for _, p := range svc.Ports {
+			ports = append(ports, p.Number)
+		}
+		return ports
+	}
+
+	// registry.example.com/library/postgres:11 -> postgres
+	return wellKnownServicePorts[protocol.ParseImageName(svc.Name).ShortName()]
+}
+
+func (s *ScriptContext) printWaitForServices(services []protocol.JobService, timeoutVal string) {
+	timeout, err := strconv.Atoi(timeoutVal)
+	if err != nil || timeout <= 0 {
+		timeout = DefaultServiceWaitTimeoutSec
+	}
+
+	s.addLine("# Wait for services")
+	for _, svc := range services {
+		ports := servicePorts(&svc)
+		if len(ports) == 0 {
+			s.addFline("echo %s", cache.Quote(fmt.Sprintf("WARNING: service %s has no declared or well known ports, its readiness is not checked", svc.Name)))
+			continue
+		}
+
+		for _, port := range ports {
+			s.printWaitForPort(svc.Name, port, timeout)
+		}
+	}
+}
+
+// Services run in the same pod, so their ports are open on the loopback interface.
+// The job fails when a service does not start listening in time
+func (s *ScriptContext) printWaitForPort(serviceName string, port int, timeout int) {
+	s.addFline("echo %s", cache.Quote(fmt.Sprintf("Waiting for service %s on port %d", serviceName, port)))
+	s.addFline("SFS_WAIT_DEADLINE=$((SECONDS + %d))", timeout)
+	s.addFline("until (exec 3<>/dev/tcp/127.0.0.1/%d) 2>/dev/null; do", port)
+	s.addLine("  if [ ${SECONDS} -ge ${SFS_WAIT_DEADLINE} ]; then")
+	s.addFline("    echo %s", cache.Quote(fmt.Sprintf("ERROR: service %s is not listening on port %d after %d seconds", serviceName, port, timeout)))
+	s.addLine("    exit 1")
+	s.addLine("  fi")
+	s.addLine("  sleep 1")
+	s.addLine("done")
+	s.addLine("unset SFS_WAIT_DEADLINE")
+}
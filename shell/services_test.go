@@ -0,0 +1,105 @@
+package shell
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"sisyphus/protocol"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_servicePorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		svc      protocol.JobService
+		expected []int
+	}{
+		{"declared ports", protocol.JobService{Name: "postgres", Ports: []protocol.JobServicePort{{Number: 15432}}}, []int{15432}},
+		{"well known", protocol.JobService{Name: "registry.example.com/library/postgres:11"}, []int{5432}},
+		{"digest", protocol.JobService{Name: "redis@sha256:abc"}, []int{6379}},
+		{"registry port", protocol.JobService{Name: "registry:5000/library/redis:5@sha256:abc"}, []int{6379}},
+		{"unknown", protocol.JobService{Name: "example/app:1"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ports := servicePorts(&tt.svc); !reflect.DeepEqual(ports, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, ports)
+			}
+		})
+	}
+}
+
+// The script waits for the ports of the services and fails when one is not listening in time
+func TestGenerateScript_waitForServices(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer listener.Close()
+	openPort := listener.Addr().(*net.TCPAddr).Port
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	_ = closed.Close()
+
+	dir, err := ioutil.TempDir("", "sfs-services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runJob := func(port int) (string, error) {
+		spec := &protocol.JobSpec{
+			Variables: []protocol.JobVariable{
+				{Key: "GIT_STRATEGY", Value: "none"},
+				{Key: SfsServiceWaitTimeout, Value: "2"},
+			},
+			Services: []protocol.JobService{
+				{Name: "example/app:1", Ports: []protocol.JobServicePort{{Number: port}}},
+				{Name: "example/worker:1"},
+			},
+			Steps: []protocol.JobStep{{Name: "script", Script: []string{"echo step-$((1 + 1))"}}},
+		}
+
+		script, err := GenerateScriptInDir(spec, nil, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := exec.Command(bash, "-c", script.Text).CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := runJob(openPort)
+	if err != nil {
+		t.Fatalf("script failed: %v %s", err, out)
+	}
+	for _, msg := range []string{"Waiting for service example/app:1 on port " + strconv.Itoa(openPort),
+		"WARNING: service example/worker:1 has no declared or well known ports", "step-2"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("trace does not contain '%s': %s", msg, out)
+		}
+	}
+
+	out, err = runJob(closedPort)
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1, got %v %s", err, out)
+	}
+	if !strings.Contains(out, "ERROR: service example/app:1 is not listening on port "+strconv.Itoa(closedPort)) || strings.Contains(out, "step-2") {
+		t.Errorf("script did not stop at the service which is not listening: %s", out)
+	}
+}
@@ -3,48 +3,95 @@ package shell
 import (
 	"fmt"
 	"net/url"
+	"path"
+	"sisyphus/cache"
 	"sisyphus/protocol"
+	"strconv"
 	"strings"
 )
 
 // Shell script generator
 const DefaultUploadName = "artifacts"
 
+// Directory of the build volume
+const DefaultBuildDir = "/build"
+
 type ScriptContext struct {
-	builder strings.Builder
+	builder   strings.Builder
+	secretEnv map[string]string
+}
+
+// Job script and the secret environment it needs, for example signed cache URLs.
+// The secrets are not part of the text, so the script can be stored and printed
+type Script struct {
+	Text      string
+	SecretEnv map[string]string
 }
 
 // Generate job script
-func GenerateScript(spec *protocol.JobSpec, cacheBucketName string) (string, error) {
+func GenerateScript(spec *protocol.JobSpec, cacheSettings *cache.Settings) (*Script, error) {
+	return GenerateScriptInDir(spec, cacheSettings, DefaultBuildDir)
+}
+
+// Generate job script which checks out the project in a subdirectory of buildDir
+func GenerateScriptInDir(spec *protocol.JobSpec, cacheSettings *cache.Settings, buildDir string) (*Script, error) {
 	env := protocol.GetEnvVars(spec)
-	ctx := ScriptContext{}
+	ctx := ScriptContext{secretEnv: make(map[string]string)}
+	cacheFile := path.Join(buildDir, "sfs-cache.archive")
+
+	cacheSettings, cacheWarning := jobCacheSettings(cacheSettings, env)
+
+	ctx.printPrelude(path.Join(buildDir, "sfs"))
+	ctx.printJobControl()
+
+	if len(cacheWarning) > 0 {
+		ctx.addFline("echo %s", cache.Quote(cacheWarning))
+	}
 
-	ctx.printPrelude(spec.JobInfo.ProjectName)
+	// Services share the pod network, wait until they accept connections
+	if len(spec.Services) > 0 {
+		ctx.printWaitForServices(spec.Services, env[SfsServiceWaitTimeout])
+	}
 
 	// GIT
 	if env["GIT_STRATEGY"] == "none" {
 		ctx.addLine("echo 'Skipping GIT checkout. GIT_STRATEGY = none'")
 	} else {
+		refspecs := gitRefspecs(&spec.GitInfo)
 		_, hasCacheVar := env[SfsEnvVarGitCache]
 		if hasCacheVar && len(env[SfsEnvVarGitCache]) > 0 {
 			// use gitcache
-			ctx.printGitDownloadCache(env[SfsEnvVarGitCache])
+			ctx.printGitDownloadCache(env[SfsEnvVarGitCache], refspecs)
 		} else {
 			// fetch git in normal way
-			ctx.printGitClone()
+			depth, depthWarning := gitDepth(&spec.GitInfo, env)
+			if len(depthWarning) > 0 {
+				ctx.addFline("echo %s", cache.Quote(depthWarning))
+			}
+
+			ctx.printGitClone(refspecs, depth)
 			ctx.printGitCleanReset()
 			ctx.printGitCheckout()
 			ctx.printGitSyncSubmodules()
 		}
 	}
 
-	// Download caches
-	for _, cache := range spec.Cache {
-		if cache.Policy == protocol.CachePolicyPull ||
-			cache.Policy == protocol.CachePolicyPullPush ||
-			cache.Policy == protocol.CachePolicyUndefined {
+	if len(spec.Cache) > 0 && cacheSettings != nil {
+		ctx.printCacheFunctions()
+	}
 
-			ctx.printDownloadCache(&cache, cacheBucketName, spec.JobInfo.ProjectName)
+	// Download caches, the fallback keys are tried when the key misses
+	for i, jobCache := range spec.Cache {
+		if jobCache.Policy != protocol.CachePolicyPush {
+			keys := []string{cacheKey(spec, jobCache.Key, env)}
+			for _, fallbackKey := range jobCache.FallbackKeys {
+				keys = append(keys, cacheKey(spec, fallbackKey, env))
+			}
+
+			err := ctx.printDownloadCache(cacheSettings, i, keys, cacheFile)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -57,23 +104,29 @@ func GenerateScript(spec *protocol.JobSpec, cacheBucketName string) (string, err
 	for _, step := range spec.Steps {
 		err := ctx.printJobStep(step)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
-	// Upload artifacts
+	// Upload artifacts, the outcome of the steps decides which ones
 	for _, artifact := range spec.Artifacts {
-		ctx.printUploadArtifact(&artifact, spec.Id, spec.Token)
+		ctx.printConditionalUploadArtifact(&artifact, spec.Id, spec.Token)
 	}
 
-	// Upload caches
-	for _, cache := range spec.Cache {
-		if cache.Policy != protocol.CachePolicyPull {
-			ctx.printUploadCache(&cache, cacheBucketName, spec.JobInfo.ProjectName)
+	// Caches are uploaded for successful jobs unless their `when` says otherwise
+	for i, jobCache := range spec.Cache {
+		if jobCache.Policy != protocol.CachePolicyPull {
+			ctx.addFline("if sfs_when %s; then", whenOrDefault(jobCache.When))
+			err := ctx.printUploadCache(&jobCache, cacheSettings, i, cacheKey(spec, jobCache.Key, env), cacheFile)
+			if err != nil {
+				return nil, err
+			}
+			ctx.addLine("fi")
 		}
 	}
 
-	return ctx.builder.String(), nil
+	ctx.printJobResult()
+	return &Script{Text: ctx.builder.String(), SecretEnv: ctx.secretEnv}, nil
 }
 
 func (s *ScriptContext) addFline(format string, a ...interface{}) {
@@ -94,7 +147,7 @@ func (s *ScriptContext) addLines(lines []string) {
 	}
 }
 
-func (s *ScriptContext) printPrelude(projectName string) {
+func (s *ScriptContext) printPrelude(projectDir string) {
 	lines := []string{
 		"#!/usr/bin/env bash",
 		"# Prelude",
@@ -104,7 +157,6 @@ func (s *ScriptContext) printPrelude(projectName string) {
 	s.addLines(lines)
 
 	// Make working dir
-	projectDir := "/build/sfs"
 	s.addFline("export CI_PROJECT_DIR=%s", projectDir)
 	s.addFline("rm -rf %s", projectDir)
 	s.addFline("mkdir -p '%s'", projectDir)
@@ -112,28 +164,126 @@ func (s *ScriptContext) printPrelude(projectName string) {
 	s.addLine("pwd")
 }
 
-// Generate git clone code
-func (s *ScriptContext) printGitClone() {
-	lines := []string{
-		"# GIT Clone",
-		"echo 'Cloning git repo'",
-		"git clone ${CI_REPOSITORY_URL} ./",
-		"git config fetch.recurseSubmodules false",
-		"git fetch --prune",
+// Shell functions tracking the outcome of the job steps.
+// SFS_JOB_EXIT holds the exit code of the first failed step, the script exits with it.
+// Steps run in background in own process group, so they can be stopped when the pod is terminated
+// (job canceled or deadline exceeded) and the `always` steps still run.
+func (s *ScriptContext) printJobControl() {
+	s.addLine("# Job control")
+	s.addLine("set -m")
+	s.addLine("SFS_JOB_EXIT=0")
+	s.addLine("SFS_JOB_CANCELED=0")
+	s.addLine(`sfs_cancel() {
+  echo 'Job is terminated'
+  SFS_JOB_CANCELED=1
+  if [ ${SFS_JOB_EXIT} -eq 0 ]; then
+    SFS_JOB_EXIT=143
+  fi
+  if [ -n "${SFS_STEP_PID:-}" ]; then
+    kill -TERM -- -${SFS_STEP_PID} 2>/dev/null || true
+  fi
+}
+trap sfs_cancel TERM INT`)
+
+	s.addFline(`sfs_when() {
+  case "$1" in
+    %s) true ;;
+    %s) [ ${SFS_JOB_EXIT} -ne 0 ] && [ ${SFS_JOB_CANCELED} -eq 0 ] ;;
+    *) [ ${SFS_JOB_EXIT} -eq 0 ] && [ ${SFS_JOB_CANCELED} -eq 0 ] ;;
+  esac
+}`, protocol.WhenAlways, protocol.WhenOnFailure)
+
+	// wait is interrupted by the trap, then the step is still being stopped
+	s.addLine(`sfs_wait_step() {
+  wait ${SFS_STEP_PID}
+  SFS_STEP_EXIT=$?
+  while kill -0 ${SFS_STEP_PID} 2>/dev/null; do
+    wait ${SFS_STEP_PID}
+    SFS_STEP_EXIT=$?
+  done
+  unset SFS_STEP_PID
+}`)
+}
+
+// Exit with the code of the main script
+func (s *ScriptContext) printJobResult() {
+	s.addLine(`# Job result
+if [ ${SFS_JOB_EXIT} -ne 0 ]; then
+  echo "Job failed with code ${SFS_JOB_EXIT}"
+  sleep 10
+fi
+exit ${SFS_JOB_EXIT}`)
+}
+
+// Refs fetched when gitlab does not send refspecs
+var defaultGitRefspecs = []string{
+	"+refs/heads/*:refs/remotes/origin/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+func gitRefspecs(gitInfo *protocol.JobGitInfo) []string {
+	if len(gitInfo.Refspecs) == 0 {
+		return defaultGitRefspecs
 	}
 
-	s.addLines(lines)
+	return gitInfo.Refspecs
 }
 
-func (s *ScriptContext) printGitFetch() {
+// GIT_DEPTH of the job overrides the depth sent by gitlab. Zero means full history.
+// A typo in the variable should not break the clone, so a bad value only produces the warning
+func gitDepth(gitInfo *protocol.JobGitInfo, env map[string]string) (int, string) {
+	val, ok := env["GIT_DEPTH"]
+	if !ok || len(val) == 0 {
+		return gitInfo.Depth, ""
+	}
+
+	depth, err := strconv.Atoi(val)
+	if err != nil || depth < 0 {
+		return gitInfo.Depth, fmt.Sprintf("WARNING: invalid GIT_DEPTH '%s', using the depth %d of the project settings", val, gitInfo.Depth)
+	}
+
+	return depth, ""
+}
+
+// Generate git clone code. Only the refspecs are fetched, shallow when depth is set
+func (s *ScriptContext) printGitClone(refspecs []string, depth int) {
+	s.addLine("# GIT Clone")
+
+	depthArg := ""
+	if depth > 0 {
+		s.addFline("echo 'Fetching git repo with depth %d'", depth)
+		depthArg = fmt.Sprintf(" --depth %d", depth)
+	} else {
+		s.addLine("echo 'Fetching git repo'")
+	}
+
+	s.addLines([]string{
+		"git init -q",
+		"git remote add origin ${CI_REPOSITORY_URL}",
+		"git config fetch.recurseSubmodules false",
+	})
+	s.addFline("git fetch --prune%s origin %s", depthArg, quoteAll(refspecs))
+}
+
+// The git cache has full history, it stays unshallow
+func (s *ScriptContext) printGitFetch(refspecs []string) {
 	lines := []string{
 		"echo 'Fetching git remotes'",
 		"git remote set-url origin ${CI_REPOSITORY_URL}",
 		"git config fetch.recurseSubmodules false",
-		"git fetch --prune",
 	}
 
 	s.addLines(lines)
+	s.addFline("git fetch --prune origin %s", quoteAll(refspecs))
+}
+
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = cache.Quote(v)
+	}
+
+	return strings.Join(quoted, " ")
 }
 
 func (s *ScriptContext) printGitCheckout() {
@@ -172,7 +322,7 @@ func (s *ScriptContext) printGitSyncSubmodules() {
 	s.addLines(lines)
 }
 
-func (s *ScriptContext) printGitDownloadCache(cacheUrl string) {
+func (s *ScriptContext) printGitDownloadCache(cacheUrl string, refspecs []string) {
 	s.addFline("# Fetching GIT cache from %s", cacheUrl)
 	s.addFline("gsutil cat %s | tar -zx", cacheUrl)
 
@@ -186,23 +336,75 @@ for CNF in $(find ./.git/modules/ -type f -name 'config'); do
 done`)
 
 	s.printGitCleanReset()
-	s.printGitFetch()
+	s.printGitFetch(refspecs)
 	s.printGitCheckout()
 	s.printGitSyncSubmodules()
 }
 
 func (s *ScriptContext) printJobStep(step protocol.JobStep) error {
 	s.addFline("# STEP %s", step.Name)
+	s.addFline("if sfs_when %s; then", whenOrDefault(step.When))
 	s.addFline("echo 'Step `%s` has %d commands'", step.Name, len(step.Script))
 	augmented, err := genStepScript(step.Script)
 	if err != nil {
 		return err
 	}
 
-	s.addLine(augmented)
+	s.printTrackedSubshell(fmt.Sprintf("Step `%s`", step.Name), augmented, step.AllowFailure)
+	s.addLine("fi")
+
 	return nil
 }
 
+// Run script in a subshell and record its exit code in SFS_STEP_EXIT.
+// Unless failure is allowed, the first failure becomes the job exit code.
+func (s *ScriptContext) printTrackedSubshell(description string, script string, allowFailure bool) {
+	// errexit is ignored in a subshell which is a part of `||` list, so the exit code is collected with wait
+	s.addLines([]string{
+		"set +e",
+		"(",
+		"set -e",
+	})
+	s.builder.WriteString(script)
+	s.addLines([]string{
+		") &",
+		"SFS_STEP_PID=$!",
+		"sfs_wait_step",
+		"set -e",
+	})
+
+	// Failures of steps like after_script do not change the job result
+	s.addLine("if [ ${SFS_STEP_EXIT} -ne 0 ]; then")
+	s.addFline("echo \"%s failed with code ${SFS_STEP_EXIT}\"", strings.Replace(description, "`", "\\`", -1))
+	if !allowFailure {
+		s.addLine("if [ ${SFS_JOB_EXIT} -eq 0 ]; then SFS_JOB_EXIT=${SFS_STEP_EXIT}; fi")
+	}
+	s.addLine("fi")
+}
+
+// Steps and artifacts without condition run only when everything before succeeded
+func whenOrDefault(when protocol.WhenCondition) protocol.WhenCondition {
+	if when == protocol.WhenUndefined {
+		return protocol.WhenOnSuccess
+	}
+
+	return when
+}
+
+// Upload artifact if its `when` condition matches the outcome of the steps.
+// Failed upload fails a successful job, but does not change the exit code of a failed one
+func (s *ScriptContext) printConditionalUploadArtifact(artifact *protocol.JobArtifact, jobId int, jobToken string) {
+	when := whenOrDefault(artifact.When)
+	s.addFline("# Artifact %s, when %s", artifact.Name, when)
+	s.addFline("if sfs_when %s; then", when)
+
+	upload := ScriptContext{}
+	upload.printUploadArtifact(artifact, jobId, jobToken)
+	s.printTrackedSubshell(fmt.Sprintf("Upload of artifact `%s`", artifact.Name), upload.builder.String(), false)
+
+	s.addLine("fi")
+}
+
 func (s *ScriptContext) printUploadArtifact(artifact *protocol.JobArtifact, jobId int, jobToken string) {
 	s.addFline("# Upload artifact %s", artifact.Name)
 	s.addLine("TMPDIR=$(mktemp -d)")
@@ -270,37 +472,6 @@ func genDownloadArtifactsSnippet(dep *protocol.JobDependency, outputFile string)
 	}
 }
 
-func makeCacheUrl(cacheBucketName string, projectName string, cacheKey string) string {
-	return fmt.Sprintf("gs://%s/%s/%s.tar.gz", cacheBucketName, projectName, cacheKey)
-}
-
-func (s *ScriptContext) printDownloadCache(cache *protocol.JobCache, cacheBucketName string, projectName string) {
-	cUrl := makeCacheUrl(cacheBucketName, projectName, cache.Key)
-	line := fmt.Sprintf("(gsutil cat %s | tar -zx) || echo \"No cache file found %s\"", cUrl, cUrl)
-
-	lines := []string{
-		fmt.Sprintf("echo \"Downloading cache %s from %s\"", cache.Key, cUrl),
-		line,
-	}
-
-	s.addLines(lines)
-}
-
-func (s *ScriptContext) printUploadCache(cache *protocol.JobCache, cacheBucketName string, projectName string) {
-	cUrl := makeCacheUrl(cacheBucketName, projectName, cache.Key)
-	inDirs := strings.Join(cache.Paths, " ")
-
-	tarCmd := fmt.Sprintf("tar -cz %s", inDirs)
-	line := fmt.Sprintf("(%s | gsutil cp - %s) || true", tarCmd, cUrl)
-
-	lines := []string{
-		fmt.Sprintf("echo \"Uploading cache %s to %s\"", cache.Key, cUrl),
-		line,
-	}
-
-	s.addLines(lines)
-}
-
 // Augment script lines
 func genStepScript(lines []string) (string, error) {
 	var sb strings.Builder
@@ -317,7 +488,5 @@ func genStepScript(lines []string) (string, error) {
 		}
 	}
 
-	// Close subshell
-	errHandler := fmt.Sprintf("(%s) || (EXIT=$?; echo \"Failed with code $EXIT\"; sleep 10 && exit $EXIT)", sb.String())
-	return errHandler, nil
+	return sb.String(), nil
 }
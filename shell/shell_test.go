@@ -1,12 +1,541 @@
 package shell
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sisyphus/cache"
+	"sisyphus/conf"
 	"sisyphus/protocol"
+	"strings"
+	"sync"
 	"testing"
 )
 
+func newTestSettings(t *testing.T, cacheConf conf.CacheConf) *cache.Settings {
+	settings, err := cache.NewSettings(&conf.SisyphusConf{Cache: cacheConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return settings
+}
+
 func TestGenerateScript(t *testing.T) {
-	script := GenerateScript(&protocol.JobSpec{}, "TEST")
-	fmt.Println(script)
+	script, err := GenerateScript(&protocol.JobSpec{}, newTestSettings(t, conf.CacheConf{Type: conf.CacheGCS, GCS: conf.GCSCacheConf{Bucket: "TEST"}}))
+	if err != nil {
+		t.Error(err)
+	}
+	fmt.Println(script.Text)
+}
+
+// Generated script must be valid bash
+func TestGenerateScript_syntax(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	jsonData, err := ioutil.ReadFile("../protocol/testdata/job_spec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := protocol.ParseJobSpec(jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs := map[string]*protocol.JobSpec{
+		"empty":     {},
+		"full spec": spec,
+	}
+
+	backends := map[string]*cache.Settings{
+		"no cache": nil,
+		"gcs":      newTestSettings(t, conf.CacheConf{Type: conf.CacheGCS, GCS: conf.GCSCacheConf{Bucket: "TEST"}}),
+		"s3": newTestSettings(t, conf.CacheConf{Type: conf.CacheS3, S3: conf.S3CacheConf{
+			Endpoint: "http://minio:9000", Region: "us-east-1", Bucket: "TEST", AccessKey: "key", SecretKey: "secret"}}),
+		"volume": newTestSettings(t, conf.CacheConf{Type: conf.CacheVolume, Volume: conf.VolumeCacheConf{ClaimName: "cache"}}),
+	}
+
+	for name, s := range specs {
+		for backendName, backend := range backends {
+			s, backend := s, backend
+			t.Run(name+" "+backendName, func(t *testing.T) {
+				script, err := GenerateScript(s, backend)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cmd := exec.Command(bash, "-n")
+				cmd.Stdin = strings.NewReader(script.Text)
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Errorf("invalid script: %v %s", err, out)
+				}
+			})
+		}
+	}
+}
+
+// The fallback key is restored when the key misses, the upload follows the policy and `when` of each cache.
+// Caches restored from their own key and not changed by the job are not uploaded again
+func TestGenerateScript_cache(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "sfs-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	archive := exec.Command("sh", "-c", "mkdir -p cache/proj src && echo cached > src/restored.txt && tar -czf cache/proj/fallback.tar.gz -C src restored.txt")
+	archive.Dir = dir
+	if out, err := archive.CombinedOutput(); err != nil {
+		t.Fatalf("%v %s", err, out)
+	}
+
+	paths := []string{"restored.txt"}
+	spec := &protocol.JobSpec{
+		JobInfo:   protocol.JobInfo{ProjectName: "proj"},
+		Variables: []protocol.JobVariable{{Key: "GIT_STRATEGY", Value: "none"}},
+		Steps:     []protocol.JobStep{{Name: "script", Script: []string{"grep cached restored.txt"}}},
+		Cache: []protocol.JobCache{
+			{Key: "main", FallbackKeys: []string{"missing", "fallback"}, Paths: paths, Policy: protocol.CachePolicyPullPush},
+			{Key: "push", Paths: paths, Policy: protocol.CachePolicyPush},
+			{Key: "failure", Paths: paths, When: protocol.WhenOnFailure},
+		},
+	}
+
+	settings := newTestSettings(t, conf.CacheConf{Type: conf.CacheVolume, Volume: conf.VolumeCacheConf{ClaimName: "cache", MountPath: cacheDir}})
+	script, err := GenerateScriptInDir(spec, settings, filepath.Join(dir, "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(script.Text, "Downloading cache from "+filepath.Join(cacheDir, "proj/push.tar.gz")) {
+		t.Error("cache with push policy is downloaded")
+	}
+
+	out, err := exec.Command(bash, "-c", script.Text).CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %v %s", err, out)
+	}
+
+	for _, msg := range []string{"Cache hit, restored from " + filepath.Join(cacheDir, "proj/fallback.tar.gz"), "Cache miss"} {
+		if !strings.Contains(string(out), msg) {
+			t.Errorf("trace does not contain '%s'", msg)
+		}
+	}
+
+	for key, expected := range map[string]bool{"main": true, "push": true, "failure": false} {
+		_, err := os.Stat(filepath.Join(cacheDir, "proj", key+".tar.gz"))
+		if (err == nil) != expected {
+			t.Errorf("cache %s uploaded: %v, expected %v", key, err == nil, expected)
+		}
+	}
+
+	// The checksum is in the archive and not left in the project dir
+	list, err := exec.Command("tar", "-tzf", filepath.Join(cacheDir, "proj", "main.tar.gz")).CombinedOutput()
+	if err != nil || !strings.Contains(string(list), cacheChecksumFile) {
+		t.Errorf("archive does not contain the checksum: %v %s", err, list)
+	}
+	left, err := exec.Command("find", filepath.Join(dir, "build"), "-name", cacheChecksumFile).CombinedOutput()
+	if err != nil || len(left) > 0 {
+		t.Errorf("checksum is left in the project dir: %v %s", err, left)
+	}
+
+	// Restored from the key itself and not changed by the job
+	out, err = exec.Command(bash, "-c", script.Text).CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %v %s", err, out)
+	}
+
+	if !strings.Contains(string(out), "Cache not changed, skipping upload to "+filepath.Join(cacheDir, "proj/main.tar.gz")) {
+		t.Errorf("unchanged cache is uploaded again: %s", out)
+	}
+}
+
+// Archives of any format are restored by jobs using another one. Too large archives are not uploaded
+func TestGenerateScript_cacheFormat(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "sfs-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	settings := newTestSettings(t, conf.CacheConf{Type: conf.CacheVolume, Volume: conf.VolumeCacheConf{ClaimName: "cache", MountPath: cacheDir}})
+
+	runJob := func(settings *cache.Settings, format string, key string, step string) string {
+		spec := &protocol.JobSpec{
+			JobInfo: protocol.JobInfo{ProjectName: "proj"},
+			Variables: []protocol.JobVariable{
+				{Key: "GIT_STRATEGY", Value: "none"},
+				{Key: SfsCacheFormat, Value: format},
+			},
+			Steps: []protocol.JobStep{{Name: "script", Script: []string{step}}},
+			Cache: []protocol.JobCache{{Key: key, Paths: []string{"data"}}},
+		}
+
+		script, err := GenerateScriptInDir(spec, settings, filepath.Join(dir, "build"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := exec.Command(bash, "-c", script.Text).CombinedOutput()
+		if err != nil {
+			t.Fatalf("script failed: %v %s", err, out)
+		}
+
+		return string(out)
+	}
+
+	formats := map[string]string{cache.FormatGzip: "1f8b", cache.FormatNone: ""}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		formats[cache.FormatZstd] = "28b52ffd"
+	}
+
+	for format, magic := range formats {
+		runJob(settings, format, format, "mkdir data && echo "+format+" > data/file")
+
+		data, err := ioutil.ReadFile(filepath.Join(cacheDir, "proj", format+".tar.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(fmt.Sprintf("%x", data), magic) {
+			t.Errorf("archive of format %s starts with %x", format, data[:4])
+		}
+		// Uncompressed tar has no magic at the start, the header has it
+		if format == cache.FormatNone && (len(data) < 262 || string(data[257:262]) != "ustar") {
+			t.Errorf("archive of format %s is not a tar", format)
+		}
+
+		// The job using the format of the runner restores the archive
+		restore := *settings
+		restore.Format = cache.FormatNone
+		out := runJob(&restore, "", format, "grep "+format+" data/file")
+		if !strings.Contains(out, "Cache hit") {
+			t.Errorf("archive of format %s is not restored: %s", format, out)
+		}
+	}
+
+	// Invalid format is reported, the job uses the format of the runner
+	out := runJob(settings, "zip", "invalid", "mkdir data && echo invalid > data/file")
+	data, err := ioutil.ReadFile(filepath.Join(cacheDir, "proj", "invalid.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "WARNING: unknown cache format 'zip'") || !strings.HasPrefix(fmt.Sprintf("%x", data), "1f8b") {
+		t.Errorf("invalid format is not replaced by the runner format: %s", out)
+	}
+
+	limited := *settings
+	limited.MaxSizeBytes = 10
+	out = runJob(&limited, cache.FormatNone, "large", "mkdir data && echo large > data/file")
+	_, err = os.Stat(filepath.Join(cacheDir, "proj", "large.tar.gz"))
+	if !strings.Contains(out, "WARNING: Cache archive of") || err == nil {
+		t.Errorf("too large archive is uploaded: %s", out)
+	}
+}
+
+func Test_jobCacheSettings(t *testing.T) {
+	settings := &cache.Settings{Format: cache.FormatZstd, Level: 10, MaxSizeBytes: 1024}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected *cache.Settings
+		warning  string
+	}{
+		{"runner settings", map[string]string{}, settings, ""},
+		{"level", map[string]string{SfsCacheCompressionLevel: "3"}, &cache.Settings{Format: cache.FormatZstd, Level: 3, MaxSizeBytes: 1024}, ""},
+		{"format", map[string]string{SfsCacheFormat: cache.FormatGzip}, &cache.Settings{Format: cache.FormatGzip, MaxSizeBytes: 1024}, ""},
+		{"invalid format", map[string]string{SfsCacheFormat: "zip"}, settings, "WARNING: unknown cache format 'zip'"},
+		{"invalid level", map[string]string{SfsCacheFormat: cache.FormatGzip, SfsCacheCompressionLevel: "10"}, settings, "WARNING: invalid compression level 10"},
+		{"level not a number", map[string]string{SfsCacheCompressionLevel: "fast"}, settings, "WARNING: invalid " + SfsCacheCompressionLevel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, warning := jobCacheSettings(settings, tt.env)
+			if *result != *tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, result)
+			}
+
+			if !strings.HasPrefix(warning, tt.warning) || (len(tt.warning) == 0 && len(warning) > 0) {
+				t.Errorf("unexpected warning '%s'", warning)
+			}
+		})
+	}
+}
+
+// Only the refspecs are fetched, with the depth of GIT_DEPTH
+func TestGenerateScript_gitShallowFetch(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "sfs-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoDir := filepath.Join(dir, "repo")
+	setup := exec.Command("sh", "-c", `set -e
+git init -q repo && cd repo && git checkout -q -b ci
+git config user.email ci@example.com && git config user.name ci
+for i in 1 2 3; do echo $i > file && git add file && git commit -q -m "commit $i"; done
+git branch -q other HEAD~1
+git rev-parse HEAD`)
+	setup.Dir = dir
+	out, err := setup.Output()
+	if err != nil {
+		t.Fatalf("%v %s", err, out)
+	}
+	sha := strings.TrimSpace(string(out))
+
+	spec := &protocol.JobSpec{
+		GitInfo: protocol.JobGitInfo{
+			Depth:    50,
+			Refspecs: []string{"+refs/heads/ci:refs/remotes/origin/ci"},
+		},
+		Variables: []protocol.JobVariable{{Key: "GIT_DEPTH", Value: "1"}},
+		Steps:     []protocol.JobStep{{Name: "script", Script: []string{"test $(git rev-list --count HEAD) -eq 1", "test -z \"$(git branch -r --list origin/other)\""}}},
+	}
+
+	script, err := GenerateScriptInDir(spec, nil, filepath.Join(dir, "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bash, "-c", script.Text)
+	cmd.Env = append(os.Environ(), "CI_REPOSITORY_URL=file://"+repoDir, "CI_COMMIT_SHA="+sha)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %v %s", err, out)
+	}
+
+	// Invalid GIT_DEPTH is reported, the depth of gitlab is used
+	spec.Variables = []protocol.JobVariable{{Key: "GIT_DEPTH", Value: "deep"}}
+	spec.Steps = []protocol.JobStep{{Name: "script", Script: []string{"test $(git rev-list --count HEAD) -eq 3"}}}
+	script, err = GenerateScriptInDir(spec, nil, filepath.Join(dir, "build-invalid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = exec.Command(bash, "-c", script.Text)
+	cmd.Env = append(os.Environ(), "CI_REPOSITORY_URL=file://"+repoDir, "CI_COMMIT_SHA="+sha)
+	out, err = cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "WARNING: invalid GIT_DEPTH 'deep', using the depth 50") {
+		t.Errorf("invalid GIT_DEPTH is not replaced by the project depth: %v %s", err, out)
+	}
+}
+
+// Run the generated script in a temporary build dir. Returns the output lines and the exit code
+func runTestScript(t *testing.T, spec *protocol.JobSpec, env ...string) ([]string, int) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "sfs-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script, err := GenerateScriptInDir(spec, nil, filepath.Join(dir, "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bash, "-c", script.Text)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(string(out), "\n"), exitCode
+}
+
+// Output lines of commands, the trace of the commands is left out
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Steps run according to their `when`, the first failure decides the exit code of the job
+func TestGenerateScript_stepWhen(t *testing.T) {
+	gitNone := []protocol.JobVariable{{Key: "GIT_STRATEGY", Value: "none"}}
+	steps := func(script string) []protocol.JobStep {
+		return []protocol.JobStep{
+			{Name: "script", Script: []string{"echo script-$((1 + 1))", script}, When: protocol.WhenOnSuccess},
+			{Name: "deploy", Script: []string{"echo deploy-$((1 + 1))"}},
+			{Name: "notify", Script: []string{"echo notify-$((1 + 1))"}, When: protocol.WhenOnFailure},
+			{Name: "after_script", Script: []string{"echo after-$((1 + 1))", "exit 5"}, When: protocol.WhenAlways, AllowFailure: true},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		script   string
+		exitCode int
+		ran      []string
+		skipped  []string
+	}{
+		{"success", "true", 0, []string{"script-2", "deploy-2", "after-2"}, []string{"notify-2"}},
+		{"failure", "exit 3", 3, []string{"script-2", "notify-2", "after-2"}, []string{"deploy-2"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			lines, exitCode := runTestScript(t, &protocol.JobSpec{Variables: gitNone, Steps: steps(tt.script)})
+			if exitCode != tt.exitCode {
+				t.Errorf("expected exit code %d, got %d", tt.exitCode, exitCode)
+			}
+
+			for _, line := range tt.ran {
+				if !containsLine(lines, line) {
+					t.Errorf("step printing %s did not run", line)
+				}
+			}
+
+			for _, line := range tt.skipped {
+				if containsLine(lines, line) {
+					t.Errorf("step printing %s ran", line)
+				}
+			}
+
+			// The failure of after_script is reported, but does not change the job result
+			if !containsLine(lines, "Step `after_script` failed with code 5") {
+				t.Errorf("failure of after_script is not reported: %s", strings.Join(lines, "\n"))
+			}
+		})
+	}
+}
+
+// Artifacts are uploaded according to their `when`. A failed upload fails a successful job only
+func TestGenerateScript_artifactWhen(t *testing.T) {
+	for _, tool := range []string{"zip", "curl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not available")
+		}
+	}
+
+	var mux sync.Mutex
+	var uploaded []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mux.Lock()
+		for _, f := range archive.File {
+			uploaded = append(uploaded, f.Name)
+		}
+		mux.Unlock()
+	}))
+	defer server.Close()
+
+	artifacts := []protocol.JobArtifact{
+		{Name: "success", Paths: []string{"success.txt"}},
+		{Name: "failure", Paths: []string{"failure.txt"}, When: protocol.WhenOnFailure},
+		{Name: "always", Paths: []string{"always.txt"}, When: protocol.WhenAlways},
+	}
+
+	tests := []struct {
+		name      string
+		script    string
+		artifacts []protocol.JobArtifact
+		exitCode  int
+		uploaded  []string
+	}{
+		{"success", "true", artifacts, 0, []string{"success.txt", "always.txt"}},
+		{"failure", "exit 3", artifacts, 3, []string{"failure.txt", "always.txt"}},
+		{"upload failure of successful job", "true",
+			[]protocol.JobArtifact{{Name: "missing", Paths: []string{"missing.txt"}}}, 12, nil},
+		{"upload failure of failed job", "exit 3",
+			[]protocol.JobArtifact{{Name: "missing", Paths: []string{"missing.txt"}, When: protocol.WhenAlways}}, 3, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux.Lock()
+			uploaded = nil
+			mux.Unlock()
+
+			spec := &protocol.JobSpec{
+				Id:        42,
+				Token:     "token",
+				Variables: []protocol.JobVariable{{Key: "GIT_STRATEGY", Value: "none"}},
+				Steps: []protocol.JobStep{{Name: "script", Script: []string{
+					"echo content | tee success.txt failure.txt always.txt",
+					tt.script,
+				}}},
+				Artifacts: tt.artifacts,
+			}
+
+			lines, exitCode := runTestScript(t, spec, "CI_API_V4_URL="+server.URL)
+			if exitCode != tt.exitCode {
+				t.Errorf("expected exit code %d, got %d: %s", tt.exitCode, exitCode, strings.Join(lines, "\n"))
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+			if !reflect.DeepEqual(uploaded, tt.uploaded) {
+				t.Errorf("expected uploads %v, got %v", tt.uploaded, uploaded)
+			}
+		})
+	}
 }
@@ -15,4 +15,13 @@ const (
 	// Should be json encoded map like '{"type"="ci", "preemptible"="true" ...}'
 	// https://kubernetes.io/docs/concepts/configuration/assign-pod-node/
 	SfsNodeSelector = "SFS_NODE_SELECTOR"
+
+	// The number of seconds to wait for each service port before the job script continues
+	SfsServiceWaitTimeout = "SFS_SERVICE_WAIT_TIMEOUT_SEC"
+
+	// Archive format of the job caches: gzip, zstd or none. Overrides the format of the runner configuration
+	SfsCacheFormat = "SFS_CACHE_FORMAT"
+
+	// Compression level of the cache archives. Overrides the level of the runner configuration
+	SfsCacheCompressionLevel = "SFS_CACHE_COMPRESSION_LEVEL"
 )